@@ -20,47 +20,130 @@ func main() {
         log.Printf("Warning: .env file not found at %s", envPath)
     }
     
+    // Admin command: re-wrap data keys after changing MASTER_KEY (old key in PREVIOUS_MASTER_KEYS)
+    if len(os.Args) > 1 && os.Args[1] == "rotate-master-key" {
+        keys, err := internal.LoadKeyRingFromEnv()
+        if err != nil {
+            log.Fatal("Failed to load master key:", err)
+        }
+        rotated, err := internal.RotateMasterKey(internal.ConnectDB(), keys)
+        if err != nil {
+            log.Fatalf("Key rotation stopped after %d chunks: %v", rotated, err)
+        }
+        log.Printf("Re-wrapped %d data keys with master key %s", rotated, keys.CurrentID)
+        return
+    }
+    
     app := internal.NewApp()
+    go app.StartTrashPurger()
     
     router := mux.NewRouter()
     
     // Auth routes
     router.HandleFunc("/api/auth/login", app.Login).Methods("POST")
     router.HandleFunc("/api/auth/register", app.Register).Methods("POST")
-    
-    // Protected routes
+    router.HandleFunc("/api/auth/2fa", app.CompleteLogin).Methods("POST")
+    router.HandleFunc("/api/auth/refresh", app.RefreshSession).Methods("POST")
+    router.HandleFunc("/api/auth/logout", app.Logout).Methods("POST")
+    router.HandleFunc("/api/auth/password-reset", app.RequestPasswordReset).Methods("POST")
+    router.HandleFunc("/api/auth/password-reset/confirm", app.ConfirmPasswordReset).Methods("POST")
+    router.HandleFunc("/api/auth/verify-email/confirm", app.ConfirmEmail).Methods("GET", "POST")
+    
+    // Protected routes; API keys only reach the routes their scopes allow
     protected := router.PathPrefix("/api").Subrouter()
     protected.Use(app.AuthMiddleware)
     protected.Use(app.RateLimitMiddleware)
+    protected.Use(app.VerifiedEmailMiddleware)
     
     // File operations
-    protected.HandleFunc("/files", app.UploadFile).Methods("POST")
-    protected.HandleFunc("/files", app.GetFiles).Methods("GET")
-    protected.HandleFunc("/files/{id}", app.DownloadFile).Methods("GET")
-    protected.HandleFunc("/files/{id}", app.DeleteFile).Methods("DELETE")
+    protected.HandleFunc("/files", app.RequireScope(internal.ScopeFilesWrite, app.UploadFile)).Methods("POST")
+    protected.HandleFunc("/files", app.RequireScope(internal.ScopeFilesRead, app.GetFiles)).Methods("GET")
+    protected.HandleFunc("/files/{id}", app.RequireScope(internal.ScopeFilesRead, app.DownloadFile)).Methods("GET", "HEAD")
+    protected.HandleFunc("/files/{id}", app.RequireScope(internal.ScopeFilesWrite, app.DeleteFile)).Methods("DELETE")
+    protected.HandleFunc("/files/{id}/metadata", app.RequireScope(internal.ScopeFilesWrite, app.UpdateFileMetadata)).Methods("PATCH")
+    protected.HandleFunc("/search", app.RequireScope(internal.ScopeFilesRead, app.SearchFiles)).Methods("GET")
+    
+    // File versions
+    protected.HandleFunc("/files/{id}/versions", app.RequireScope(internal.ScopeFilesRead, app.ListFileVersions)).Methods("GET")
+    protected.HandleFunc("/files/{id}/versions", app.RequireScope(internal.ScopeFilesWrite, app.PruneFileVersions)).Methods("DELETE")
+    protected.HandleFunc("/files/{id}/versions/{version}", app.RequireScope(internal.ScopeFilesRead, app.DownloadFileVersion)).Methods("GET", "HEAD")
+    protected.HandleFunc("/files/{id}/versions/{version}/restore", app.RequireScope(internal.ScopeFilesWrite, app.RestoreFileVersion)).Methods("POST")
+    
+    // Resumable uploads (tus)
+    router.HandleFunc("/api/uploads", app.TusOptions).Methods("OPTIONS")
+    protected.HandleFunc("/uploads", app.RequireScope(internal.ScopeFilesWrite, app.CreateUpload)).Methods("POST")
+    protected.HandleFunc("/uploads/{id}", app.RequireScope(internal.ScopeFilesWrite, app.UploadStatus)).Methods("HEAD")
+    protected.HandleFunc("/uploads/{id}", app.RequireScope(internal.ScopeFilesWrite, app.PatchUpload)).Methods("PATCH")
+    protected.HandleFunc("/uploads/{id}", app.RequireScope(internal.ScopeFilesWrite, app.TerminateUpload)).Methods("DELETE")
     
     // User profile
     protected.HandleFunc("/user/me", app.GetProfile).Methods("GET")
+    protected.HandleFunc("/auth/logout-all", app.RequireSession(app.LogoutAll)).Methods("POST")
+    protected.HandleFunc("/auth/verify-email", app.RequireSession(app.ResendVerification)).Methods("POST")
+    
+    // Two-factor authentication
+    protected.HandleFunc("/2fa/enroll", app.RequireSession(app.EnrollTwoFactor)).Methods("POST")
+    protected.HandleFunc("/2fa/verify", app.RequireSession(app.VerifyTwoFactor)).Methods("POST")
+    protected.HandleFunc("/2fa/disable", app.RequireSession(app.DisableTwoFactor)).Methods("POST")
+    protected.HandleFunc("/2fa/recovery-codes", app.RequireSession(app.RegenerateRecoveryCodes)).Methods("POST")
+    
+    // API keys (managed from a login session only)
+    protected.HandleFunc("/api-keys", app.RequireSession(app.CreateAPIKey)).Methods("POST")
+    protected.HandleFunc("/api-keys", app.RequireSession(app.ListAPIKeys)).Methods("GET")
+    protected.HandleFunc("/api-keys/{id}", app.RequireSession(app.RevokeAPIKey)).Methods("DELETE")
     
     // Directory operations
-    protected.HandleFunc("/directories", app.CreateDirectory).Methods("POST")
-    protected.HandleFunc("/directories", app.ListDirectory).Methods("GET")
+    protected.HandleFunc("/directories", app.RequireScope(internal.ScopeFilesWrite, app.CreateDirectory)).Methods("POST")
+    protected.HandleFunc("/directories", app.RequireScope(internal.ScopeFilesRead, app.ListDirectory)).Methods("GET")
+    protected.HandleFunc("/directories", app.RequireScope(internal.ScopeFilesWrite, app.DeleteDirectory)).Methods("DELETE")
+    protected.HandleFunc("/directories/archive", app.RequireScope(internal.ScopeFilesRead, app.ArchiveDirectory)).Methods("GET")
+    protected.HandleFunc("/stat", app.RequireScope(internal.ScopeFilesRead, app.StatPath)).Methods("GET")
+    protected.HandleFunc("/download", app.RequireScope(internal.ScopeFilesRead, app.DownloadByPath)).Methods("GET", "HEAD")
+    
+    // Tags
+    protected.HandleFunc("/tags", app.RequireScope(internal.ScopeFilesRead, app.ListTags)).Methods("GET")
+    protected.HandleFunc("/tags/assign", app.RequireScope(internal.ScopeFilesWrite, app.AddTags)).Methods("POST")
+    protected.HandleFunc("/tags/unassign", app.RequireScope(internal.ScopeFilesWrite, app.RemoveTags)).Methods("POST")
+    protected.HandleFunc("/tags/{id}", app.RequireScope(internal.ScopeFilesWrite, app.RenameTag)).Methods("PATCH")
+    protected.HandleFunc("/tags/{id}", app.RequireScope(internal.ScopeFilesWrite, app.DeleteTag)).Methods("DELETE")
+    
+    // Trash
+    protected.HandleFunc("/trash", app.RequireScope(internal.ScopeFilesRead, app.ListTrash)).Methods("GET")
+    protected.HandleFunc("/trash", app.RequireScope(internal.ScopeFilesWrite, app.PurgeTrash)).Methods("DELETE")
+    protected.HandleFunc("/trash/{id}", app.RequireScope(internal.ScopeFilesWrite, app.PurgeTrash)).Methods("DELETE")
+    protected.HandleFunc("/trash/{id}/restore", app.RequireScope(internal.ScopeFilesWrite, app.RestoreTrash)).Methods("POST")
+    
+    // Snapshots
+    protected.HandleFunc("/snapshots", app.RequireScope(internal.ScopeFilesWrite, app.CreateSnapshot)).Methods("POST")
+    protected.HandleFunc("/snapshots", app.RequireScope(internal.ScopeFilesRead, app.ListSnapshots)).Methods("GET")
+    protected.HandleFunc("/snapshots/{id}", app.RequireScope(internal.ScopeFilesWrite, app.DeleteSnapshot)).Methods("DELETE")
+    protected.HandleFunc("/snapshots/{id}/browse", app.RequireScope(internal.ScopeFilesRead, app.BrowseSnapshot)).Methods("GET")
+    protected.HandleFunc("/snapshots/{id}/download", app.RequireScope(internal.ScopeFilesRead, app.DownloadSnapshotFile)).Methods("GET", "HEAD")
+    protected.HandleFunc("/snapshots/{id}/diff", app.RequireScope(internal.ScopeFilesRead, app.DiffSnapshot)).Methods("GET")
+    protected.HandleFunc("/snapshots/{id}/restore", app.RequireScope(internal.ScopeFilesWrite, app.RestoreSnapshot)).Methods("POST")
     
     // Sharing
-    protected.HandleFunc("/files/{id}/share", app.CreateShare).Methods("POST")
+    protected.HandleFunc("/files/{id}/share", app.RequireScope(internal.ScopeSharesCreate, app.CreateShare)).Methods("POST")
     
     // Public sharing (no auth required)
-    router.HandleFunc("/api/share/{token}", app.GetSharedFile).Methods("GET")
+    router.HandleFunc("/api/share/{token}", app.GetSharedFile).Methods("GET", "HEAD")
     
     // Linking
-    protected.HandleFunc("/hard-links", app.CreateHardLink).Methods("POST")
-    protected.HandleFunc("/soft-links", app.CreateSoftLink).Methods("POST")
+    protected.HandleFunc("/hard-links", app.RequireScope(internal.ScopeFilesWrite, app.CreateHardLink)).Methods("POST")
+    protected.HandleFunc("/soft-links", app.RequireScope(internal.ScopeFilesWrite, app.CreateSoftLink)).Methods("POST")
+    
+    // Move / rename / copy
+    protected.HandleFunc("/move", app.RequireScope(internal.ScopeFilesWrite, app.MoveNode)).Methods("POST", "PATCH")
+    protected.HandleFunc("/copy", app.RequireScope(internal.ScopeFilesWrite, app.CopyNode)).Methods("POST")
     
     // Admin routes
-    protected.HandleFunc("/admin/stats", app.GetStorageStats).Methods("GET")
-    protected.HandleFunc("/admin/users", app.GetAllUsers).Methods("GET")
-    protected.HandleFunc("/admin/users/{id}/quota", app.UpdateUserQuota).Methods("PUT")
-    protected.HandleFunc("/admin/audit-logs", app.GetAuditLogs).Methods("GET")
+    protected.HandleFunc("/admin/stats", app.RequireScope(internal.ScopeAdmin, app.RequireTwoFactor(app.GetStorageStats))).Methods("GET")
+    protected.HandleFunc("/admin/users", app.RequireScope(internal.ScopeAdmin, app.RequireTwoFactor(app.GetAllUsers))).Methods("GET")
+    protected.HandleFunc("/admin/users/{id}/quota", app.RequireScope(internal.ScopeAdmin, app.RequireTwoFactor(app.UpdateUserQuota))).Methods("PUT")
+    protected.HandleFunc("/admin/users/{id}/logout", app.RequireScope(internal.ScopeAdmin, app.RequireTwoFactor(app.RevokeUserSessions))).Methods("POST")
+    protected.HandleFunc("/admin/settings/security", app.RequireScope(internal.ScopeAdmin, app.RequireTwoFactor(app.GetSecuritySettings))).Methods("GET")
+    protected.HandleFunc("/admin/settings/security", app.RequireScope(internal.ScopeAdmin, app.RequireTwoFactor(app.UpdateSecuritySettings))).Methods("PUT")
+    protected.HandleFunc("/admin/audit-logs", app.RequireScope(internal.ScopeAdmin, app.RequireTwoFactor(app.GetAuditLogs))).Methods("GET")
     
     // Health check
     router.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
@@ -71,8 +154,9 @@ func main() {
     // CORS
     c := cors.New(cors.Options{
         AllowedOrigins: []string{"http://localhost:3000"},
-        AllowedMethods: []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
+        AllowedMethods: []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
         AllowedHeaders: []string{"*"},
+        ExposedHeaders: []string{"Content-Length", "Content-Range", "Content-Disposition", "Accept-Ranges", "ETag", "Location", "Tus-Resumable", "Tus-Version", "Tus-Extension", "Upload-Offset", "Upload-Length", "Upload-Expires", "Upload-File-Id", "X-Total-Count", "X-Next-Cursor"},
         AllowCredentials: true,
     })
     
@@ -0,0 +1,298 @@
+package internal
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "log"
+    "net/http"
+    "net/url"
+    "os"
+    "strings"
+    "time"
+
+    "github.com/golang-jwt/jwt/v5"
+    "golang.org/x/crypto/bcrypt"
+
+    "file-vault/pkg"
+)
+
+// Password reset and email verification links carry a signed JWT (purpose, user,
+// expiry) whose jti is recorded in AccountToken, which makes each link single-use
+const (
+    PurposePasswordReset = "password_reset"
+    PurposeVerifyEmail   = "verify_email"
+
+    passwordResetTTL  = time.Hour
+    verifyEmailTTL    = 48 * time.Hour
+    accountMailPeriod = time.Minute // Minimum gap between two emails of one kind to a user
+    minPasswordLength = 8
+)
+
+var ErrInvalidAccountToken = errors.New("invalid, expired or already used link")
+
+func publicURLFromEnv() string {
+    if value := os.Getenv("PUBLIC_URL"); value != "" {
+        return strings.TrimSuffix(value, "/")
+    }
+    return "http://localhost:3000"
+}
+
+func requireVerifiedEmailFromEnv() bool {
+    return os.Getenv("REQUIRE_EMAIL_VERIFICATION") == "true"
+}
+
+// issueAccountToken signs a single-use token for purpose and records its jti. Older
+// unused tokens for the same purpose stop working, so only the latest email counts.
+func (app *App) issueAccountToken(user *User, purpose string, ttl time.Duration) (string, error) {
+    jti := utils.GenerateToken()
+    expiresAt := time.Now().Add(ttl)
+
+    claims := jwt.MapClaims{
+        "user_id": user.ID,
+        "jti":     jti,
+        "typ":     purpose,
+        "exp":     expiresAt.Unix(),
+    }
+    // A verification link only confirms the address it was sent to
+    if purpose == PurposeVerifyEmail {
+        claims["email"] = user.Email
+    }
+    token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(app.JWTSecret))
+    if err != nil {
+        return "", err
+    }
+
+    now := time.Now()
+    app.DB.Model(&AccountToken{}).Where("user_id = ? AND purpose = ? AND used_at IS NULL", user.ID, purpose).Update("used_at", now)
+    err = app.DB.Create(&AccountToken{JTI: jti, UserID: user.ID, Purpose: purpose, ExpiresAt: expiresAt}).Error
+    return token, err
+}
+
+// consumeAccountToken validates a token for purpose and marks it used
+func (app *App) consumeAccountToken(tokenString, purpose string) (*User, jwt.MapClaims, error) {
+    token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+        return []byte(app.JWTSecret), nil
+    }, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
+    if err != nil || !token.Valid {
+        return nil, nil, ErrInvalidAccountToken
+    }
+
+    claims, _ := token.Claims.(jwt.MapClaims)
+    userID, ok := claims["user_id"].(float64)
+    jti, _ := claims["jti"].(string)
+    if typ, _ := claims["typ"].(string); !ok || typ != purpose || jti == "" {
+        return nil, nil, ErrInvalidAccountToken
+    }
+
+    result := app.DB.Model(&AccountToken{}).
+        Where("jti = ? AND purpose = ? AND used_at IS NULL", jti, purpose).
+        Update("used_at", time.Now())
+    if result.Error != nil || result.RowsAffected == 0 {
+        return nil, nil, ErrInvalidAccountToken
+    }
+
+    var user User
+    if err := app.DB.First(&user, uint(userID)).Error; err != nil {
+        return nil, nil, ErrInvalidAccountToken
+    }
+    return &user, claims, nil
+}
+
+// recentlyMailed reports whether a purpose email went to the user within accountMailPeriod
+func (app *App) recentlyMailed(userID uint, purpose string) bool {
+    var count int64
+    app.DB.Model(&AccountToken{}).
+        Where("user_id = ? AND purpose = ? AND created_at > ?", userID, purpose, time.Now().Add(-accountMailPeriod)).
+        Count(&count)
+    return count > 0
+}
+
+// purgeExpiredAccountTokens drops tokens past their expiry, used or not
+func (app *App) purgeExpiredAccountTokens() {
+    app.DB.Where("expires_at < ?", time.Now()).Delete(&AccountToken{})
+}
+
+// sendAccountMail issues a purpose token and mails its link, unless one was mailed moments ago
+func (app *App) sendAccountMail(user *User, purpose string) error {
+    app.purgeExpiredAccountTokens()
+    if app.recentlyMailed(user.ID, purpose) {
+        return nil
+    }
+
+    var ttl time.Duration
+    var subject, path, intro string
+    switch purpose {
+    case PurposePasswordReset:
+        ttl, subject, path = passwordResetTTL, "Reset your File Vault password", "/reset-password"
+        intro = "Someone asked to reset the password of your File Vault account. If it was you, open this link to choose a new one:"
+    default:
+        ttl, subject, path = verifyEmailTTL, "Verify your File Vault email address", "/verify-email"
+        intro = "Confirm that this is the email address of your File Vault account by opening this link:"
+    }
+
+    token, err := app.issueAccountToken(user, purpose, ttl)
+    if err != nil {
+        return err
+    }
+
+    msg := Message{
+        To:      user.Email,
+        Subject: subject,
+        Body: fmt.Sprintf("Hi %s,\n\n%s\n\n%s%s?token=%s\n\nThe link expires in %s and works once. If you didn't ask for this, ignore this email.\n",
+            user.Username, intro, app.PublicURL, path, url.QueryEscape(token), ttl),
+    }
+    return app.Mailer.Send(msg)
+}
+
+// unverifiedAllowed lists what an unverified account can still reach. Enrolling in 2FA
+// stays open, as an admin who must have it can't get anywhere else without it.
+var unverifiedAllowed = map[string]bool{
+    "/api/user/me":           true,
+    "/api/auth/verify-email": true,
+    "/api/auth/logout-all":   true,
+    "/api/2fa/enroll":        true,
+    "/api/2fa/verify":        true,
+}
+
+// VerifiedEmailMiddleware confines unverified accounts to their profile, re-sending the
+// verification email and 2FA enrollment, when REQUIRE_EMAIL_VERIFICATION is on
+func (app *App) VerifiedEmailMiddleware(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if !app.RequireVerifiedEmail || unverifiedAllowed[r.URL.Path] {
+            next.ServeHTTP(w, r)
+            return
+        }
+
+        var user User
+        if app.DB.Select("id", "email_verified").First(&user, app.getUserID(r)).Error == nil && !user.EmailVerified {
+            http.Error(w, "Verify your email address first", http.StatusForbidden)
+            return
+        }
+        next.ServeHTTP(w, r)
+    })
+}
+
+// Account recovery handlers
+
+// RequestPasswordReset mails a reset link. The account lookup and all the work for an
+// existing account happen after responding, so neither the answer nor its timing
+// reveals whether the address has an account.
+func (app *App) RequestPasswordReset(w http.ResponseWriter, r *http.Request) {
+    var req struct {
+        Email string `json:"email"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Email == "" {
+        http.Error(w, "email is required", http.StatusBadRequest)
+        return
+    }
+
+    go func(email string) {
+        var user User
+        if err := app.DB.Where("email = ?", email).First(&user).Error; err != nil {
+            return
+        }
+        if err := app.sendAccountMail(&user, PurposePasswordReset); err != nil {
+            log.Printf("Failed to send password reset email to user %d: %v", user.ID, err)
+        }
+    }(req.Email)
+
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(http.StatusAccepted)
+    json.NewEncoder(w).Encode(map[string]string{"message": "If the address has an account, a reset link is on its way"})
+}
+
+// ConfirmPasswordReset sets a new password and ends every session of the account
+func (app *App) ConfirmPasswordReset(w http.ResponseWriter, r *http.Request) {
+    var req struct {
+        Token    string `json:"token"`
+        Password string `json:"password"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Token == "" {
+        http.Error(w, "token is required", http.StatusBadRequest)
+        return
+    }
+    if len(req.Password) < minPasswordLength {
+        http.Error(w, fmt.Sprintf("Password must be at least %d characters", minPasswordLength), http.StatusBadRequest)
+        return
+    }
+
+    user, _, err := app.consumeAccountToken(req.Token, PurposePasswordReset)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+    if err != nil {
+        http.Error(w, "Failed to reset password", http.StatusInternalServerError)
+        return
+    }
+    // Receiving the reset email also proves the address
+    if err := app.DB.Model(user).Updates(map[string]interface{}{"password": string(hashedPassword), "email_verified": true}).Error; err != nil {
+        http.Error(w, "Failed to reset password", http.StatusInternalServerError)
+        return
+    }
+    if err := app.RevokeAllSessions(user.ID); err != nil {
+        log.Printf("Failed to revoke sessions of user %d after password reset: %v", user.ID, err)
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]string{"message": "Password reset; log in with your new password"})
+}
+
+// ResendVerification mails the current user a new verification link
+func (app *App) ResendVerification(w http.ResponseWriter, r *http.Request) {
+    var user User
+    if err := app.DB.First(&user, app.getUserID(r)).Error; err != nil {
+        http.Error(w, "User not found", http.StatusNotFound)
+        return
+    }
+    if user.EmailVerified {
+        http.Error(w, "Email address is already verified", http.StatusConflict)
+        return
+    }
+    if err := app.sendAccountMail(&user, PurposeVerifyEmail); err != nil {
+        http.Error(w, "Failed to send verification email", http.StatusInternalServerError)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(http.StatusAccepted)
+    json.NewEncoder(w).Encode(map[string]string{"message": "Verification email sent"})
+}
+
+// ConfirmEmail marks the address a verification link was sent to as verified. GET with
+// ?token= lets the emailed link work without a frontend page.
+func (app *App) ConfirmEmail(w http.ResponseWriter, r *http.Request) {
+    var req struct {
+        Token string `json:"token"`
+    }
+    if r.Method == http.MethodGet {
+        req.Token = r.URL.Query().Get("token")
+    } else {
+        json.NewDecoder(r.Body).Decode(&req)
+    }
+    if req.Token == "" {
+        http.Error(w, "token is required", http.StatusBadRequest)
+        return
+    }
+
+    user, claims, err := app.consumeAccountToken(req.Token, PurposeVerifyEmail)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    if email, _ := claims["email"].(string); email != user.Email {
+        http.Error(w, ErrInvalidAccountToken.Error(), http.StatusBadRequest)
+        return
+    }
+
+    if err := app.DB.Model(user).Update("email_verified", true).Error; err != nil {
+        http.Error(w, "Failed to verify email", http.StatusInternalServerError)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]string{"message": "Email address verified"})
+}
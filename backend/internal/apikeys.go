@@ -0,0 +1,203 @@
+package internal
+
+import (
+    "context"
+    "encoding/json"
+    "net/http"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/gorilla/mux"
+
+    "file-vault/pkg"
+)
+
+// API keys are long-lived bearer tokens for scripts and CI. Unlike a login session they
+// only grant the scopes they were created with; keys are stored hashed and shown once.
+const (
+    ScopeFilesRead    = "files:read"
+    ScopeFilesWrite   = "files:write"
+    ScopeSharesCreate = "shares:create"
+    ScopeAdmin        = "admin"
+
+    apiKeyPrefix = "fvk_"
+
+    // last_used_at is only rewritten this often, so busy keys don't write on every request
+    apiKeyUsageResolution = time.Minute
+)
+
+var validScopes = map[string]bool{
+    ScopeFilesRead:    true,
+    ScopeFilesWrite:   true,
+    ScopeSharesCreate: true,
+    ScopeAdmin:        true,
+}
+
+// isAPIKey tells API keys apart from JWTs in an Authorization header
+func isAPIKey(token string) bool {
+    return strings.HasPrefix(token, apiKeyPrefix)
+}
+
+// authenticateAPIKey returns the live key matching raw and records its use
+func (app *App) authenticateAPIKey(raw string) (*APIKey, bool) {
+    var key APIKey
+    if err := app.DB.Where("key_hash = ?", utils.CalculateHash([]byte(raw))).First(&key).Error; err != nil {
+        return nil, false
+    }
+    now := time.Now()
+    if key.RevokedAt != nil || (key.ExpiresAt != nil && now.After(*key.ExpiresAt)) {
+        return nil, false
+    }
+
+    if key.LastUsedAt == nil || now.Sub(*key.LastUsedAt) > apiKeyUsageResolution {
+        app.DB.Model(&key).Update("last_used_at", now)
+    }
+    return &key, true
+}
+
+// requestScopes returns the scopes of the request's API key, or nil for a login
+// session, which has every scope its user's role allows
+func requestScopes(r *http.Request) []string {
+    scopes, _ := r.Context().Value("scopes").([]string)
+    return scopes
+}
+
+func hasScope(r *http.Request, scope string) bool {
+    scopes := requestScopes(r)
+    if scopes == nil {
+        return true
+    }
+    for _, s := range scopes {
+        if s == scope {
+            return true
+        }
+    }
+    return false
+}
+
+// withAPIKey puts the key's owner and scopes on the request context
+func withAPIKey(r *http.Request, key *APIKey) *http.Request {
+    ctx := context.WithValue(r.Context(), "userID", key.UserID)
+    ctx = context.WithValue(ctx, "scopes", key.ScopeList())
+    return r.WithContext(ctx)
+}
+
+// RequireScope rejects API keys without scope; login sessions always pass
+func (app *App) RequireScope(scope string, next http.HandlerFunc) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        if !hasScope(r, scope) {
+            http.Error(w, "API key lacks the "+scope+" scope", http.StatusForbidden)
+            return
+        }
+        next(w, r)
+    }
+}
+
+// RequireSession rejects API keys, for routes that manage credentials
+func (app *App) RequireSession(next http.HandlerFunc) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        if requestScopes(r) != nil {
+            http.Error(w, "This endpoint requires a login session, not an API key", http.StatusForbidden)
+            return
+        }
+        next(w, r)
+    }
+}
+
+// API key handlers
+func (app *App) CreateAPIKey(w http.ResponseWriter, r *http.Request) {
+    userID := app.getUserID(r)
+
+    var req struct {
+        Name          string   `json:"name"`
+        Scopes        []string `json:"scopes"`
+        ExpiresInDays int      `json:"expires_in_days"` // 0 means no expiry
+    }
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        http.Error(w, "Invalid request", http.StatusBadRequest)
+        return
+    }
+    req.Name = strings.TrimSpace(req.Name)
+    if req.Name == "" || len(req.Scopes) == 0 || req.ExpiresInDays < 0 {
+        http.Error(w, "name and scopes are required", http.StatusBadRequest)
+        return
+    }
+
+    seen := make(map[string]bool)
+    var scopes []string
+    for _, scope := range req.Scopes {
+        if !validScopes[scope] {
+            http.Error(w, "Unknown scope: "+scope, http.StatusBadRequest)
+            return
+        }
+        if !seen[scope] {
+            seen[scope] = true
+            scopes = append(scopes, scope)
+        }
+    }
+
+    var user User
+    if err := app.DB.First(&user, userID).Error; err != nil {
+        http.Error(w, "User not found", http.StatusNotFound)
+        return
+    }
+    if seen[ScopeAdmin] && user.Role != "admin" {
+        http.Error(w, "Only admins can create keys with the admin scope", http.StatusForbidden)
+        return
+    }
+
+    raw := apiKeyPrefix + utils.GenerateToken()
+    key := &APIKey{
+        UserID:  userID,
+        Name:    req.Name,
+        Prefix:  raw[:len(apiKeyPrefix)+8],
+        KeyHash: utils.CalculateHash([]byte(raw)),
+        Scopes:  strings.Join(scopes, ","),
+    }
+    if req.ExpiresInDays > 0 {
+        expiresAt := time.Now().Add(time.Duration(req.ExpiresInDays) * 24 * time.Hour)
+        key.ExpiresAt = &expiresAt
+    }
+    if err := app.DB.Create(key).Error; err != nil {
+        http.Error(w, "Failed to create API key", http.StatusInternalServerError)
+        return
+    }
+
+    // The raw key is only ever returned here
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(http.StatusCreated)
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "key":     raw,
+        "api_key": key,
+    })
+}
+
+func (app *App) ListAPIKeys(w http.ResponseWriter, r *http.Request) {
+    userID := app.getUserID(r)
+
+    var keys []APIKey
+    app.DB.Where("user_id = ?", userID).Order("created_at desc").Find(&keys)
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(keys)
+}
+
+func (app *App) RevokeAPIKey(w http.ResponseWriter, r *http.Request) {
+    userID := app.getUserID(r)
+    keyID, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+    var key APIKey
+    if err := app.DB.Where("id = ? AND user_id = ?", keyID, userID).First(&key).Error; err != nil {
+        http.Error(w, "API key not found", http.StatusNotFound)
+        return
+    }
+    if key.RevokedAt == nil {
+        now := time.Now()
+        key.RevokedAt = &now
+        app.DB.Model(&key).Update("revoked_at", now)
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]string{"message": "API key revoked"})
+}
@@ -0,0 +1,270 @@
+package internal
+
+import (
+    "archive/tar"
+    "archive/zip"
+    "compress/gzip"
+    "fmt"
+    "io"
+    "log"
+    "net/http"
+    "os"
+    "path/filepath"
+    "time"
+)
+
+// archiveWriter is the part of zip/tar output the directory walk needs
+type archiveWriter interface {
+    Dir(name string, modTime time.Time) error
+    File(name string, fileNode FileNode, content io.Reader) error
+    // HardLink records name as another link to an already written file; returns false
+    // when the format can't, so the caller writes the content again
+    HardLink(name, linkTo string, fileNode FileNode) (bool, error)
+    Symlink(name, target string, modTime time.Time) error
+    Close() error
+}
+
+// archiveWalker streams a subtree into an archive, one file's blocks at a time
+type archiveWalker struct {
+    fs           *FileSystem
+    userID       uint
+    out          archiveWriter
+    followLinks  bool
+    writtenBlock map[uint]string // DataBlockID -> first archive name holding it
+    ancestors    map[uint]bool   // Directories on the current walk path, to stop symlink cycles
+}
+
+// walk writes dir's children under the archive name prefix
+func (a *archiveWalker) walk(dir *TrieNode, prefix string) error {
+    a.ancestors[dir.ID] = true
+    defer delete(a.ancestors, dir.ID)
+
+    var children []TrieNode
+    if err := a.fs.DB.Where("parent_id = ? AND owner_id = ?", dir.ID, a.userID).Order("name").Find(&children).Error; err != nil {
+        return err
+    }
+
+    for i := range children {
+        if err := a.writeNode(&children[i], prefix+children[i].Name); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+func (a *archiveWalker) writeNode(node *TrieNode, name string) error {
+    switch node.NodeType {
+    case "directory":
+        if err := a.out.Dir(name, node.CreatedAt); err != nil {
+            return err
+        }
+        return a.walk(node, name+"/")
+
+    case "symlink":
+        var link SymLinkNode
+        a.fs.DB.Where("trie_node_id = ?", node.ID).First(&link)
+
+        if a.followLinks {
+            target, err := a.fs.Resolve(node.Path, true, a.userID)
+            // Dangling links, loops and directory cycles stay links
+            if err == nil && !a.ancestors[target.ID] {
+                return a.writeNode(target, name)
+            }
+        }
+
+        // Targets are absolute in the owner's tree; relative links survive extraction
+        target := link.TargetPath
+        if rel, err := filepath.Rel(filepath.Dir(node.Path), link.TargetPath); err == nil {
+            target = filepath.ToSlash(rel)
+        }
+        return a.out.Symlink(name, target, node.CreatedAt)
+
+    default:
+        var fileNode FileNode
+        if err := a.fs.DB.Preload("DataBlock").Where("trie_node_id = ?", node.ID).First(&fileNode).Error; err != nil {
+            return nil // trie node without content (e.g. an interrupted upload)
+        }
+
+        // Files sharing a data block are hard links (or dedup copies) of one another
+        if first, ok := a.writtenBlock[fileNode.DataBlockID]; ok {
+            if linked, err := a.out.HardLink(name, first, fileNode); linked || err != nil {
+                return err
+            }
+        }
+
+        content, err := openDataBlock(a.fs.DB, a.fs.Blobs, a.fs.Keys, fileNode.DataBlock)
+        if err != nil {
+            return err
+        }
+        defer content.Close()
+
+        if err := a.out.File(name, fileNode, content); err != nil {
+            return err
+        }
+        if _, ok := a.writtenBlock[fileNode.DataBlockID]; !ok {
+            a.writtenBlock[fileNode.DataBlockID] = name
+        }
+        return nil
+    }
+}
+
+// zipArchive writes zip entries; zip has no hard links, so shared content is repeated
+type zipArchive struct {
+    zw *zip.Writer
+}
+
+func (z *zipArchive) Dir(name string, modTime time.Time) error {
+    _, err := z.zw.CreateHeader(&zip.FileHeader{Name: name + "/", Modified: modTime})
+    return err
+}
+
+func (z *zipArchive) File(name string, fileNode FileNode, content io.Reader) error {
+    header := &zip.FileHeader{Name: name, Method: zip.Deflate, Modified: fileModTime(fileNode)}
+    // Already-compressed formats are stored as-is, as with chunk compression
+    if codecForMime(fileNode.ActualMimeType) == CodecNone {
+        header.Method = zip.Store
+    }
+    header.SetMode(0o644)
+
+    entry, err := z.zw.CreateHeader(header)
+    if err != nil {
+        return err
+    }
+    _, err = io.Copy(entry, content)
+    return err
+}
+
+func (z *zipArchive) HardLink(name, linkTo string, fileNode FileNode) (bool, error) {
+    return false, nil
+}
+
+// Symlink uses the Info-ZIP convention: symlink mode bits, target as content
+func (z *zipArchive) Symlink(name, target string, modTime time.Time) error {
+    header := &zip.FileHeader{Name: name, Method: zip.Store, Modified: modTime}
+    header.SetMode(os.ModeSymlink | 0o777)
+
+    entry, err := z.zw.CreateHeader(header)
+    if err != nil {
+        return err
+    }
+    _, err = io.WriteString(entry, target)
+    return err
+}
+
+func (z *zipArchive) Close() error {
+    return z.zw.Close()
+}
+
+// tarArchive writes a gzipped tar, with hard links for repeated data blocks
+type tarArchive struct {
+    gz *gzip.Writer
+    tw *tar.Writer
+}
+
+func (t *tarArchive) Dir(name string, modTime time.Time) error {
+    return t.tw.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: name + "/", Mode: 0o755, ModTime: modTime})
+}
+
+func (t *tarArchive) File(name string, fileNode FileNode, content io.Reader) error {
+    err := t.tw.WriteHeader(&tar.Header{
+        Typeflag: tar.TypeReg,
+        Name:     name,
+        Size:     fileNode.Size,
+        Mode:     0o644,
+        ModTime:  fileModTime(fileNode),
+    })
+    if err != nil {
+        return err
+    }
+    _, err = io.Copy(t.tw, content)
+    return err
+}
+
+func (t *tarArchive) HardLink(name, linkTo string, fileNode FileNode) (bool, error) {
+    err := t.tw.WriteHeader(&tar.Header{
+        Typeflag: tar.TypeLink,
+        Name:     name,
+        Linkname: linkTo,
+        Mode:     0o644,
+        ModTime:  fileModTime(fileNode),
+    })
+    return err == nil, err
+}
+
+func (t *tarArchive) Symlink(name, target string, modTime time.Time) error {
+    return t.tw.WriteHeader(&tar.Header{Typeflag: tar.TypeSymlink, Name: name, Linkname: target, Mode: 0o777, ModTime: modTime})
+}
+
+func (t *tarArchive) Close() error {
+    if err := t.tw.Close(); err != nil {
+        return err
+    }
+    return t.gz.Close()
+}
+
+// ArchiveDirectory streams ?path= as ?format=zip (default) or tar.gz.
+// ?follow_symlinks=true archives what links point to instead of the links.
+func (app *App) ArchiveDirectory(w http.ResponseWriter, r *http.Request) {
+    userID := app.getUserID(r)
+    dirPath := r.URL.Query().Get("path")
+    if dirPath == "" {
+        dirPath = "/"
+    }
+
+    fs := NewFileSystem(app.DB, app.Blobs, app.Keys, userID)
+    dir, err := fs.Resolve(dirPath, true, userID)
+    if err != nil {
+        http.Error(w, err.Error(), resolveErrorStatus(err))
+        return
+    }
+    if dir.NodeType != "directory" {
+        http.Error(w, "Path is not a directory", http.StatusBadRequest)
+        return
+    }
+
+    // Entries sit under a folder named after the directory; the root has none
+    name, prefix := "files", ""
+    if dir.Path != "/" {
+        name, prefix = dir.Name, dir.Name+"/"
+    }
+
+    var out archiveWriter
+    switch format := r.URL.Query().Get("format"); format {
+    case "", "zip":
+        w.Header().Set("Content-Type", "application/zip")
+        w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s.zip\"", name))
+        out = &zipArchive{zw: zip.NewWriter(w)}
+    case "tar.gz", "tgz":
+        w.Header().Set("Content-Type", "application/gzip")
+        w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s.tar.gz\"", name))
+        gz := gzip.NewWriter(w)
+        out = &tarArchive{gz: gz, tw: tar.NewWriter(gz)}
+    default:
+        http.Error(w, "format must be zip or tar.gz", http.StatusBadRequest)
+        return
+    }
+
+    walker := &archiveWalker{
+        fs:           fs,
+        userID:       userID,
+        out:          out,
+        followLinks:  r.URL.Query().Get("follow_symlinks") == "true",
+        writtenBlock: make(map[uint]string),
+        ancestors:    make(map[uint]bool),
+    }
+
+    if prefix != "" {
+        err = out.Dir(dir.Name, dir.CreatedAt)
+    }
+    if err == nil {
+        err = walker.walk(dir, prefix)
+    }
+    if err == nil {
+        err = out.Close()
+    }
+    if err != nil {
+        // Headers are gone; abort so the client sees a broken transfer, not a short archive
+        log.Printf("Archive of %s failed: %v", dir.Path, err)
+        panic(http.ErrAbortHandler)
+    }
+}
@@ -0,0 +1,323 @@
+package internal
+
+import (
+    "encoding/json"
+    "errors"
+    "net/http"
+    "os"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/golang-jwt/jwt/v5"
+    "github.com/gorilla/mux"
+    "gorm.io/gorm"
+
+    "file-vault/pkg"
+)
+
+// Sessions: logins get a short-lived access JWT and a refresh token that is stored
+// (hashed) server-side and rotated on every use. Each access token carries a jti, so
+// logout can denylist it before it expires.
+const (
+    defaultAccessTokenTTL  = 15 * time.Minute
+    defaultRefreshTokenTTL = 30 * 24 * time.Hour
+)
+
+var ErrInvalidRefreshToken = errors.New("invalid or expired refresh token")
+
+func accessTokenTTLFromEnv() time.Duration {
+    return durationFromEnv("ACCESS_TOKEN_TTL", defaultAccessTokenTTL)
+}
+
+func refreshTokenTTLFromEnv() time.Duration {
+    return durationFromEnv("REFRESH_TOKEN_TTL", defaultRefreshTokenTTL)
+}
+
+// durationFromEnv reads a Go duration ("15m", "720h") from name
+func durationFromEnv(name string, fallback time.Duration) time.Duration {
+    d, err := time.ParseDuration(os.Getenv(name))
+    if err != nil || d <= 0 {
+        return fallback
+    }
+    return d
+}
+
+// tokenPair is what login, registration and refresh return
+type tokenPair struct {
+    Token        string `json:"token"`
+    RefreshToken string `json:"refresh_token"`
+    ExpiresIn    int    `json:"expires_in"` // Seconds until Token expires
+}
+
+// issueAccessToken signs an access JWT and returns it with its jti
+func (app *App) issueAccessToken(userID uint) (string, string, error) {
+    jti := utils.GenerateToken()
+    now := time.Now()
+    token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+        "user_id": userID,
+        "jti":     jti,
+        "typ":     "access",
+        "iat":     now.Unix(),
+        "exp":     now.Add(app.AccessTokenTTL).Unix(),
+    })
+
+    tokenString, err := token.SignedString([]byte(app.JWTSecret))
+    return tokenString, jti, err
+}
+
+// startSession issues the first token pair of a new session (refresh token family)
+func (app *App) startSession(userID uint, r *http.Request) (*tokenPair, error) {
+    return app.issueTokenPair(app.DB, userID, utils.GenerateToken(), r)
+}
+
+// issueTokenPair creates an access token and the refresh token that can replace it
+func (app *App) issueTokenPair(tx *gorm.DB, userID uint, familyID string, r *http.Request) (*tokenPair, error) {
+    accessToken, jti, err := app.issueAccessToken(userID)
+    if err != nil {
+        return nil, err
+    }
+
+    refreshToken := utils.GenerateToken()
+    err = tx.Create(&RefreshToken{
+        UserID:    userID,
+        FamilyID:  familyID,
+        TokenHash: utils.CalculateHash([]byte(refreshToken)),
+        AccessJTI: jti,
+        ExpiresAt: time.Now().Add(app.RefreshTokenTTL),
+        UserAgent: r.UserAgent(),
+        IPAddress: r.RemoteAddr,
+    }).Error
+    if err != nil {
+        return nil, err
+    }
+
+    return &tokenPair{
+        Token:        accessToken,
+        RefreshToken: refreshToken,
+        ExpiresIn:    int(app.AccessTokenTTL.Seconds()),
+    }, nil
+}
+
+// RotateRefreshToken - Exchanges a refresh token for a new pair. A token is good for one
+// use; presenting a rotated one again means it leaked, so its whole family is revoked.
+func (app *App) RotateRefreshToken(refreshToken string, r *http.Request) (*tokenPair, error) {
+    var current RefreshToken
+    if err := app.DB.Where("token_hash = ?", utils.CalculateHash([]byte(refreshToken))).First(&current).Error; err != nil {
+        return nil, ErrInvalidRefreshToken
+    }
+    if current.RevokedAt != nil {
+        app.revokeSessions("family_id = ?", current.FamilyID)
+        return nil, ErrInvalidRefreshToken
+    }
+    if time.Now().After(current.ExpiresAt) {
+        return nil, ErrInvalidRefreshToken
+    }
+
+    var pair *tokenPair
+    err := app.DB.Transaction(func(tx *gorm.DB) error {
+        // Only one of two concurrent refreshes with the same token wins
+        result := tx.Model(&RefreshToken{}).Where("id = ? AND revoked_at IS NULL", current.ID).Update("revoked_at", time.Now())
+        if result.Error != nil {
+            return result.Error
+        }
+        if result.RowsAffected == 0 {
+            return ErrInvalidRefreshToken
+        }
+
+        var err error
+        pair, err = app.issueTokenPair(tx, current.UserID, current.FamilyID, r)
+        return err
+    })
+    return pair, err
+}
+
+// revokeSessions revokes the refresh tokens matching the condition and denylists the
+// access tokens issued with them that may still be unexpired
+func (app *App) revokeSessions(condition string, args ...interface{}) error {
+    var tokens []RefreshToken
+    err := app.DB.Where(condition, args...).Where("created_at > ?", time.Now().Add(-app.AccessTokenTTL)).Find(&tokens).Error
+    if err != nil {
+        return err
+    }
+    for _, token := range tokens {
+        if err := app.revokeAccessToken(token.AccessJTI, token.UserID, token.CreatedAt.Add(app.AccessTokenTTL)); err != nil {
+            return err
+        }
+    }
+
+    return app.DB.Model(&RefreshToken{}).Where(condition, args...).
+        Where("revoked_at IS NULL").Update("revoked_at", time.Now()).Error
+}
+
+// RevokeAllSessions - Logs a user out everywhere
+func (app *App) RevokeAllSessions(userID uint) error {
+    return app.revokeSessions("user_id = ?", userID)
+}
+
+// revokeAccessToken denylists a jti until the token it belongs to expires
+func (app *App) revokeAccessToken(jti string, userID uint, expiresAt time.Time) error {
+    if jti == "" {
+        return nil
+    }
+    return app.DB.Where(RevokedToken{JTI: jti}).
+        Attrs(RevokedToken{UserID: userID, ExpiresAt: expiresAt}).
+        FirstOrCreate(&RevokedToken{}).Error
+}
+
+// isTokenRevoked reports whether a jti is on the denylist
+func (app *App) isTokenRevoked(jti string) bool {
+    var count int64
+    app.DB.Model(&RevokedToken{}).Where("jti = ?", jti).Count(&count)
+    return count > 0
+}
+
+// purgeExpiredTokens drops denylist entries and refresh tokens nothing can use anymore
+func (app *App) purgeExpiredTokens() {
+    now := time.Now()
+    app.DB.Where("expires_at < ?", now).Delete(&RevokedToken{})
+    app.DB.Where("expires_at < ?", now).Delete(&RefreshToken{})
+}
+
+// parseAccessToken validates an access JWT and returns its user id and jti
+func (app *App) parseAccessToken(tokenString string) (uint, string, error) {
+    token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+        return []byte(app.JWTSecret), nil
+    }, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
+    if err != nil || !token.Valid {
+        return 0, "", errors.New("invalid token")
+    }
+
+    claims, ok := token.Claims.(jwt.MapClaims)
+    if !ok {
+        return 0, "", errors.New("invalid token claims")
+    }
+    userID, ok := claims["user_id"].(float64)
+    jti, _ := claims["jti"].(string)
+    typ, _ := claims["typ"].(string)
+    // Tokens from before revocation existed have no jti and can't be revoked;
+    // 2FA challenge tokens are signed with the same secret but aren't sessions
+    if !ok || jti == "" || (typ != "" && typ != "access") {
+        return 0, "", errors.New("invalid token claims")
+    }
+    return uint(userID), jti, nil
+}
+
+// bearerToken returns the token of an "Authorization: Bearer" header
+func bearerToken(r *http.Request) string {
+    return strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+}
+
+// writeSession starts a session for user and responds with its tokens and the user
+func (app *App) writeSession(w http.ResponseWriter, r *http.Request, user *User) {
+    app.purgeExpiredTokens()
+
+    pair, err := app.startSession(user.ID, r)
+    if err != nil {
+        http.Error(w, "Failed to start session", http.StatusInternalServerError)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "token":         pair.Token,
+        "refresh_token": pair.RefreshToken,
+        "expires_in":    pair.ExpiresIn,
+        "user":          user,
+    })
+}
+
+// Session handlers
+func (app *App) RefreshSession(w http.ResponseWriter, r *http.Request) {
+    var req struct {
+        RefreshToken string `json:"refresh_token"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.RefreshToken == "" {
+        http.Error(w, "refresh_token is required", http.StatusBadRequest)
+        return
+    }
+
+    app.purgeExpiredTokens()
+
+    pair, err := app.RotateRefreshToken(req.RefreshToken, r)
+    if err == ErrInvalidRefreshToken {
+        http.Error(w, err.Error(), http.StatusUnauthorized)
+        return
+    }
+    if err != nil {
+        http.Error(w, "Failed to refresh session", http.StatusInternalServerError)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(pair)
+}
+
+// Logout ends the session of the given refresh token and revokes the presented access
+// token. Either may be missing, so clients with an expired access token can still log out.
+func (app *App) Logout(w http.ResponseWriter, r *http.Request) {
+    var req struct {
+        RefreshToken string `json:"refresh_token"`
+    }
+    json.NewDecoder(r.Body).Decode(&req)
+
+    if req.RefreshToken != "" {
+        var session RefreshToken
+        if err := app.DB.Where("token_hash = ?", utils.CalculateHash([]byte(req.RefreshToken))).First(&session).Error; err == nil {
+            if err := app.revokeSessions("family_id = ?", session.FamilyID); err != nil {
+                http.Error(w, "Failed to log out", http.StatusInternalServerError)
+                return
+            }
+        }
+    }
+
+    if userID, jti, err := app.parseAccessToken(bearerToken(r)); err == nil {
+        // The token was issued in the past, so it expires within one TTL from now
+        if err := app.revokeAccessToken(jti, userID, time.Now().Add(app.AccessTokenTTL)); err != nil {
+            http.Error(w, "Failed to log out", http.StatusInternalServerError)
+            return
+        }
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]string{"message": "Logged out"})
+}
+
+// LogoutAll ends every session of the current user
+func (app *App) LogoutAll(w http.ResponseWriter, r *http.Request) {
+    userID := app.getUserID(r)
+
+    if err := app.RevokeAllSessions(userID); err != nil {
+        http.Error(w, "Failed to log out", http.StatusInternalServerError)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]string{"message": "All sessions logged out"})
+}
+
+// RevokeUserSessions lets an admin end every session of another user
+func (app *App) RevokeUserSessions(w http.ResponseWriter, r *http.Request) {
+    userID := app.getUserID(r)
+    targetUserID, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+    var currentUser User
+    if app.DB.First(&currentUser, userID).Error != nil || currentUser.Role != "admin" {
+        http.Error(w, "Access denied", http.StatusForbidden)
+        return
+    }
+
+    var user User
+    if app.DB.First(&user, targetUserID).Error != nil {
+        http.Error(w, "User not found", http.StatusNotFound)
+        return
+    }
+
+    if err := app.RevokeAllSessions(user.ID); err != nil {
+        http.Error(w, "Failed to log out", http.StatusInternalServerError)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]string{"message": "All sessions logged out"})
+}
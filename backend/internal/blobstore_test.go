@@ -0,0 +1,55 @@
+package internal
+
+import (
+    "bytes"
+    "io"
+    "strings"
+    "testing"
+)
+
+func readBlob(t *testing.T, store BlobStore, hash string) string {
+    t.Helper()
+    rc, err := store.Get(hash)
+    if err != nil {
+        t.Fatalf("Get(%s): %v", hash, err)
+    }
+    defer rc.Close()
+    data, err := io.ReadAll(rc)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return string(data)
+}
+
+func TestLocalBlobStorePutKeepsReplaceOverwrites(t *testing.T) {
+    store, err := NewLocalBlobStore(t.TempDir())
+    if err != nil {
+        t.Fatal(err)
+    }
+    hash := strings.Repeat("ab", 32)
+
+    if _, err := store.Put(hash, strings.NewReader("first")); err != nil {
+        t.Fatal(err)
+    }
+    if _, err := store.Put(hash, strings.NewReader("second")); err != nil {
+        t.Fatal(err)
+    }
+    if got := readBlob(t, store, hash); got != "first" {
+        t.Errorf("after Put over an existing blob got %q, want %q", got, "first")
+    }
+
+    n, err := store.Replace(hash, bytes.NewReader([]byte("third")))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if got := readBlob(t, store, hash); got != "third" || n != 5 {
+        t.Errorf("after Replace got %q (%d bytes), want %q", got, n, "third")
+    }
+
+    if err := store.Delete(hash); err != nil {
+        t.Fatal(err)
+    }
+    if _, err := store.Get(hash); err != ErrBlobNotFound {
+        t.Errorf("Get after Delete = %v, want ErrBlobNotFound", err)
+    }
+}
@@ -0,0 +1,435 @@
+package internal
+
+import (
+    "bytes"
+    "errors"
+    "io"
+    "log"
+    "sort"
+
+    "gorm.io/gorm"
+    "gorm.io/gorm/clause"
+)
+
+// FastCDC content-defined chunking: boundaries follow the content, so an edit
+// only changes the chunks around it and the rest dedupe against earlier uploads
+const (
+    chunkMinSize = 16 << 10
+    chunkAvgSize = 64 << 10
+    chunkMaxSize = 256 << 10
+
+    // Normalized chunking: harder cut condition below the average size, easier above
+    chunkMaskS = uint64(1<<18-1) << (64 - 18)
+    chunkMaskL = uint64(1<<14-1) << (64 - 14)
+)
+
+// Gear table must never change, or existing content would re-chunk differently
+var gearTable = func() [256]uint64 {
+    var table [256]uint64
+    seed := uint64(0x46494c455641554c) // "FILEVAUL"
+    for i := range table {
+        // splitmix64
+        seed += 0x9e3779b97f4a7c15
+        z := seed
+        z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+        z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+        table[i] = z ^ (z >> 31)
+    }
+    return table
+}()
+
+// chunkBoundary returns the length of the first chunk in data
+func chunkBoundary(data []byte) int {
+    n := len(data)
+    if n <= chunkMinSize {
+        return n
+    }
+    if n > chunkMaxSize {
+        n = chunkMaxSize
+    }
+    normal := chunkAvgSize
+    if n < normal {
+        normal = n
+    }
+
+    var fp uint64
+    i := chunkMinSize
+    for ; i < normal; i++ {
+        fp = (fp << 1) + gearTable[data[i]]
+        if fp&chunkMaskS == 0 {
+            return i + 1
+        }
+    }
+    for ; i < n; i++ {
+        fp = (fp << 1) + gearTable[data[i]]
+        if fp&chunkMaskL == 0 {
+            return i + 1
+        }
+    }
+    return n
+}
+
+// splitChunks streams r and calls fn for each chunk; fn must not retain the slice
+func splitChunks(r io.Reader, fn func(chunk []byte) error) error {
+    buf := make([]byte, chunkMaxSize)
+    n := 0
+    eof := false
+
+    for {
+        for !eof && n < len(buf) {
+            m, err := r.Read(buf[n:])
+            n += m
+            if err == io.EOF {
+                eof = true
+            } else if err != nil {
+                return err
+            }
+        }
+        if n == 0 {
+            return nil
+        }
+
+        cut := chunkBoundary(buf[:n])
+        if err := fn(buf[:cut]); err != nil {
+            return err
+        }
+        n = copy(buf, buf[cut:n])
+    }
+}
+
+// storeChunks splits content into chunks, storing new ones (compressed when it pays off,
+// then encrypted when a master key is configured) and recording the block's manifest
+func (fs *FileSystem) storeChunks(block *DataBlock, content io.Reader, mimeType string) error {
+    seq := 0
+    offset := int64(0)
+    codec := codecForMime(mimeType)
+
+    return splitChunks(content, func(data []byte) error {
+        chunk, err := fs.storeChunk(data, codec)
+        if err != nil {
+            return err
+        }
+
+        entry := BlockChunk{
+            DataBlockID: block.ID,
+            Seq:         seq,
+            ChunkID:     chunk.ID,
+            Offset:      offset,
+            Size:        int64(len(data)),
+        }
+        if err := fs.DB.Create(&entry).Error; err != nil {
+            return err
+        }
+
+        seq++
+        offset += int64(len(data))
+        return nil
+    })
+}
+
+// storeChunk takes a reference on the chunk holding data, storing it first if it is new
+func (fs *FileSystem) storeChunk(data []byte, codec string) (*Chunk, error) {
+    hash := fs.calculateHash(data)
+
+    var chunk Chunk
+    if fs.DB.Where("hash = ?", hash).First(&chunk).Error != nil {
+        stored := false
+        // The row is claimed before the blob is written and both commit together: a racing
+        // first store of the same hash waits on the unique index, then finds this row. The
+        // blob is overwritten, since bytes left under the key by an earlier, since deleted
+        // row were sealed with another data key. Holding the key's lock keeps
+        // deleteBlobIfUnused from removing the blob between the write and the commit.
+        err := fs.DB.Transaction(func(tx *gorm.DB) error {
+            if err := lockBlobKey(tx, hash); err != nil {
+                return err
+            }
+            chunk = Chunk{Hash: hash, Size: int64(len(data)), RefCount: 1, Codec: CodecNone}
+
+            // A legacy whole-file block with these exact bytes already holds them raw
+            var legacy int64
+            if err := tx.Model(&DataBlock{}).Where("hash = ? AND chunked = ?", hash, false).Count(&legacy).Error; err != nil {
+                return err
+            }
+            blob := data
+            if legacy == 0 {
+                var err error
+                if blob, chunk.Codec, err = compressChunk(codec, data); err != nil {
+                    return err
+                }
+                if fs.Keys != nil {
+                    dataKey, err := NewDataKey()
+                    if err != nil {
+                        return err
+                    }
+                    if blob, err = encryptChunk(dataKey, hash, blob); err != nil {
+                        return err
+                    }
+                    if chunk.WrappedKey, chunk.KeyID, err = fs.Keys.Wrap(dataKey); err != nil {
+                        return err
+                    }
+                }
+            }
+            chunk.StoredSize = int64(len(blob))
+
+            result := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&chunk)
+            if result.Error != nil || result.RowsAffected == 0 {
+                return result.Error
+            }
+            stored = true
+            if legacy > 0 {
+                return nil
+            }
+            _, err := fs.Blobs.Replace(hash, bytes.NewReader(blob))
+            return err
+        })
+        if err != nil {
+            return nil, err
+        }
+        if stored {
+            return &chunk, nil
+        }
+    }
+
+    result := fs.DB.Model(&Chunk{}).Where("hash = ?", hash).Update("ref_count", gorm.Expr("ref_count + 1"))
+    if result.Error != nil {
+        return nil, result.Error
+    }
+    if result.RowsAffected == 0 {
+        // Released and deleted since it was looked up; store it anew
+        return fs.storeChunk(data, codec)
+    }
+    if err := fs.DB.Where("hash = ?", hash).First(&chunk).Error; err != nil {
+        return nil, err
+    }
+    return &chunk, nil
+}
+
+// releaseDataBlock deletes an unreferenced block and any chunks no other block uses.
+// It returns the blob keys that may now be unused; pass them to reclaimBlobs once the
+// surrounding transaction has committed.
+func (fs *FileSystem) releaseDataBlock(block *DataBlock) ([]string, error) {
+    if err := fs.DB.Where("data_block_id = ?", block.ID).Delete(&DocumentText{}).Error; err != nil {
+        return nil, err
+    }
+    if !block.Chunked {
+        return []string{block.Hash}, fs.DB.Delete(block).Error
+    }
+
+    var entries []BlockChunk
+    if err := fs.DB.Where("data_block_id = ?", block.ID).Find(&entries).Error; err != nil {
+        return nil, err
+    }
+    for _, entry := range entries {
+        if err := fs.DB.Model(&Chunk{}).Where("id = ?", entry.ChunkID).Update("ref_count", gorm.Expr("ref_count - 1")).Error; err != nil {
+            return nil, err
+        }
+    }
+    if err := fs.DB.Where("data_block_id = ?", block.ID).Delete(&BlockChunk{}).Error; err != nil {
+        return nil, err
+    }
+    if err := fs.DB.Delete(block).Error; err != nil {
+        return nil, err
+    }
+
+    var orphans []Chunk
+    fs.DB.Where("ref_count <= 0").Find(&orphans)
+    hashes := make([]string, 0, len(orphans))
+    for _, chunk := range orphans {
+        if err := fs.DB.Delete(&chunk).Error; err != nil {
+            return nil, err
+        }
+        hashes = append(hashes, chunk.Hash)
+    }
+    return hashes, nil
+}
+
+// reclaimBlobs deletes blobs that no chunk or data block references anymore
+func (fs *FileSystem) reclaimBlobs(hashes []string) {
+    for _, hash := range hashes {
+        fs.deleteBlobIfUnused(hash)
+    }
+}
+
+// A legacy whole-file block and a chunk with identical bytes share one blob key. The
+// check and the delete run under the key's lock, so a chunk stored meanwhile either
+// commits first and is counted, or writes its blob after the delete.
+func (fs *FileSystem) deleteBlobIfUnused(hash string) {
+    err := fs.DB.Transaction(func(tx *gorm.DB) error {
+        if err := lockBlobKey(tx, hash); err != nil {
+            return err
+        }
+
+        var chunks, legacy int64
+        if err := tx.Model(&Chunk{}).Where("hash = ?", hash).Count(&chunks).Error; err != nil {
+            return err
+        }
+        if err := tx.Model(&DataBlock{}).Where("hash = ? AND chunked = ?", hash, false).Count(&legacy).Error; err != nil {
+            return err
+        }
+        if chunks > 0 || legacy > 0 {
+            return nil
+        }
+        return fs.Blobs.Delete(hash)
+    })
+    if err != nil {
+        log.Printf("Failed to delete blob %s: %v", hash, err)
+    }
+}
+
+// lockBlobKey serializes the writers and reclaimers of one blob key until tx ends
+func lockBlobKey(tx *gorm.DB, hash string) error {
+    return tx.Exec("SELECT pg_advisory_xact_lock(hashtext(?))", hash).Error
+}
+
+// openDataBlock returns a block's content, reassembling chunked blocks on the fly
+func openDataBlock(db *gorm.DB, blobs BlobStore, keys *KeyRing, block DataBlock) (io.ReadCloser, error) {
+    if !block.Chunked {
+        return blobs.Get(block.Hash)
+    }
+
+    var entries []BlockChunk
+    if err := db.Where("data_block_id = ?", block.ID).Order("seq").Preload("Chunk").Find(&entries).Error; err != nil {
+        return nil, err
+    }
+    return &chunkReader{blobs: blobs, keys: keys, entries: entries, size: block.Size}, nil
+}
+
+// openChunk returns a chunk's original bytes, decrypting and decompressing as recorded
+func openChunk(blobs BlobStore, keys *KeyRing, chunk Chunk) (io.ReadCloser, error) {
+    encrypted := len(chunk.WrappedKey) > 0
+    compressed := chunk.Codec != "" && chunk.Codec != CodecNone
+
+    blob, err := blobs.Get(chunk.Hash)
+    if err != nil || (!encrypted && !compressed) {
+        return blob, err
+    }
+    defer blob.Close()
+
+    // Chunks are small (at most chunkMaxSize), so decode in memory and stay seekable
+    data, err := io.ReadAll(blob)
+    if err != nil {
+        return nil, err
+    }
+
+    if encrypted {
+        if keys == nil {
+            return nil, ErrUnknownMasterKey
+        }
+        dataKey, err := keys.Unwrap(chunk.WrappedKey, chunk.KeyID)
+        if err != nil {
+            return nil, err
+        }
+        if data, err = decryptChunk(dataKey, chunk.Hash, data); err != nil {
+            return nil, err
+        }
+    }
+
+    if data, err = decompressChunk(chunk.Codec, data); err != nil {
+        return nil, err
+    }
+    return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+// chunkReader is a seekable view over a block's ordered chunk manifest
+type chunkReader struct {
+    blobs   BlobStore
+    keys    *KeyRing
+    entries []BlockChunk
+    size    int64
+    pos     int64
+    cur     io.ReadCloser
+    curIdx  int
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+    if c.pos >= c.size {
+        return 0, io.EOF
+    }
+    if c.cur == nil {
+        if err := c.open(); err != nil {
+            return 0, err
+        }
+    }
+
+    entry := c.entries[c.curIdx]
+    end := entry.Offset + entry.Size
+    if remaining := end - c.pos; int64(len(p)) > remaining {
+        p = p[:remaining]
+    }
+
+    n, err := c.cur.Read(p)
+    c.pos += int64(n)
+    if c.pos == end {
+        c.cur.Close()
+        c.cur = nil
+        err = nil
+    } else if err == io.EOF {
+        err = io.ErrUnexpectedEOF
+    }
+    return n, err
+}
+
+// open positions a reader for the chunk containing pos
+func (c *chunkReader) open() error {
+    idx := sort.Search(len(c.entries), func(i int) bool {
+        return c.entries[i].Offset+c.entries[i].Size > c.pos
+    })
+    if idx == len(c.entries) {
+        return io.ErrUnexpectedEOF
+    }
+
+    entry := c.entries[idx]
+    blob, err := openChunk(c.blobs, c.keys, entry.Chunk)
+    if err != nil {
+        return err
+    }
+
+    if skip := c.pos - entry.Offset; skip > 0 {
+        if seeker, ok := blob.(io.Seeker); ok {
+            _, err = seeker.Seek(skip, io.SeekStart)
+        } else {
+            _, err = io.CopyN(io.Discard, blob, skip)
+        }
+        if err != nil {
+            blob.Close()
+            return err
+        }
+    }
+
+    c.cur = blob
+    c.curIdx = idx
+    return nil
+}
+
+func (c *chunkReader) Seek(offset int64, whence int) (int64, error) {
+    var pos int64
+    switch whence {
+    case io.SeekStart:
+        pos = offset
+    case io.SeekCurrent:
+        pos = c.pos + offset
+    case io.SeekEnd:
+        pos = c.size + offset
+    default:
+        return 0, errors.New("invalid whence")
+    }
+    if pos < 0 {
+        return 0, errors.New("negative position")
+    }
+
+    if pos != c.pos && c.cur != nil {
+        c.cur.Close()
+        c.cur = nil
+    }
+    c.pos = pos
+    return pos, nil
+}
+
+func (c *chunkReader) Close() error {
+    if c.cur != nil {
+        err := c.cur.Close()
+        c.cur = nil
+        return err
+    }
+    return nil
+}
@@ -0,0 +1,104 @@
+package internal
+
+import (
+    "bytes"
+    "math/rand"
+    "testing"
+)
+
+func randomBytes(seed int64, n int) []byte {
+    data := make([]byte, n)
+    rand.New(rand.NewSource(seed)).Read(data)
+    return data
+}
+
+// chunkAll returns copies of the chunks splitChunks yields for data
+func chunkAll(t *testing.T, data []byte) [][]byte {
+    t.Helper()
+    var chunks [][]byte
+    err := splitChunks(bytes.NewReader(data), func(chunk []byte) error {
+        chunks = append(chunks, append([]byte{}, chunk...))
+        return nil
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    return chunks
+}
+
+func TestChunkBoundarySizes(t *testing.T) {
+    tests := []struct {
+        name string
+        data []byte
+        want int // -1 means anywhere in [chunkMinSize, chunkMaxSize]
+    }{
+        {"empty", nil, 0},
+        {"shorter than min", make([]byte, 100), 100},
+        {"exactly min", make([]byte, chunkMinSize), chunkMinSize},
+        {"zeros never cut", make([]byte, 2*chunkMaxSize), chunkMaxSize},
+        {"random", randomBytes(1, 2*chunkMaxSize), -1},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            got := chunkBoundary(tt.data)
+            switch {
+            case tt.want >= 0 && got != tt.want:
+                t.Errorf("chunkBoundary = %d, want %d", got, tt.want)
+            case tt.want < 0 && (got < chunkMinSize || got > chunkMaxSize):
+                t.Errorf("chunkBoundary = %d, outside [%d, %d]", got, chunkMinSize, chunkMaxSize)
+            }
+        })
+    }
+}
+
+func TestSplitChunksReassembles(t *testing.T) {
+    for _, size := range []int{0, 1, chunkMinSize - 1, chunkMinSize + 1, chunkMaxSize, 3*chunkMaxSize + 7, 4 << 20} {
+        data := randomBytes(int64(size), size)
+        chunks := chunkAll(t, data)
+        if got := bytes.Join(chunks, nil); !bytes.Equal(got, data) {
+            t.Fatalf("size %d: reassembled %d bytes differ from input", size, len(got))
+        }
+        for i, chunk := range chunks {
+            if len(chunk) > chunkMaxSize || (len(chunk) < chunkMinSize && i != len(chunks)-1) {
+                t.Errorf("size %d: chunk %d has %d bytes", size, i, len(chunk))
+            }
+        }
+    }
+}
+
+// An insertion must only change the chunks around it; everything after resynchronizes
+func TestChunkBoundaryStability(t *testing.T) {
+    data := randomBytes(42, 8<<20)
+    original := chunkAll(t, data)
+
+    tests := []struct {
+        name string
+        at   int
+        edit []byte
+    }{
+        {"insert byte at start", 0, []byte{0x5a}},
+        {"insert byte in middle", 4 << 20, []byte{0x01}},
+        {"insert block near end", 7 << 20, randomBytes(7, 1000)},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            edited := append(append(append([]byte{}, data[:tt.at]...), tt.edit...), data[tt.at:]...)
+            chunks := chunkAll(t, edited)
+
+            known := make(map[string]bool)
+            for _, chunk := range original {
+                known[string(chunk)] = true
+            }
+            changed := 0
+            for _, chunk := range chunks {
+                if !known[string(chunk)] {
+                    changed++
+                }
+            }
+            // The edited chunk, plus at most one more while the rolling hash resyncs
+            if changed > 2 {
+                t.Errorf("%d of %d chunks changed, want at most 2", changed, len(chunks))
+            }
+        })
+    }
+}
@@ -0,0 +1,105 @@
+package internal
+
+import (
+    "bytes"
+    "compress/gzip"
+    "fmt"
+    "io"
+    "mime"
+    "os"
+    "strings"
+
+    "github.com/klauspost/compress/zstd"
+)
+
+const (
+    CodecNone = "none"
+    CodecGzip = "gzip"
+    CodecZstd = "zstd"
+)
+
+// Keep a compressed chunk only if it is at most this fraction of the original
+const maxCompressionRatio = 0.9
+
+var zstdEncoder, _ = zstd.NewWriter(nil)
+var zstdDecoder, _ = zstd.NewReader(nil)
+
+// Formats that are already compressed; trial compression would only burn CPU
+var incompressiblePrefixes = []string{
+    "image/jpeg", "image/png", "image/gif", "image/webp", "image/avif", "image/heic",
+    "video/", "audio/", "font/woff",
+    "application/zip", "application/gzip", "application/x-gzip", "application/zstd",
+    "application/x-7z-compressed", "application/x-rar-compressed", "application/x-bzip2",
+    "application/x-xz", "application/vnd.rar",
+}
+
+// defaultCodec reads COMPRESSION_CODEC (zstd, gzip or none; zstd by default)
+func defaultCodec() string {
+    switch codec := os.Getenv("COMPRESSION_CODEC"); codec {
+    case CodecNone, CodecGzip, CodecZstd:
+        return codec
+    default:
+        return CodecZstd
+    }
+}
+
+// codecForMime picks the codec to try for a block based on its sniffed MIME type
+func codecForMime(mimeType string) string {
+    mediaType, _, err := mime.ParseMediaType(mimeType)
+    if err != nil {
+        mediaType = strings.ToLower(mimeType)
+    }
+
+    for _, prefix := range incompressiblePrefixes {
+        if strings.HasPrefix(mediaType, prefix) {
+            return CodecNone
+        }
+    }
+    return defaultCodec()
+}
+
+// compressChunk trial-compresses data, falling back to none when it doesn't pay off
+func compressChunk(codec string, data []byte) ([]byte, string, error) {
+    var compressed []byte
+    switch codec {
+    case CodecNone:
+        return data, CodecNone, nil
+    case CodecZstd:
+        compressed = zstdEncoder.EncodeAll(data, nil)
+    case CodecGzip:
+        var buf bytes.Buffer
+        zw := gzip.NewWriter(&buf)
+        if _, err := zw.Write(data); err != nil {
+            return nil, "", err
+        }
+        if err := zw.Close(); err != nil {
+            return nil, "", err
+        }
+        compressed = buf.Bytes()
+    default:
+        return nil, "", fmt.Errorf("unknown codec: %s", codec)
+    }
+
+    if float64(len(compressed)) > float64(len(data))*maxCompressionRatio {
+        return data, CodecNone, nil
+    }
+    return compressed, codec, nil
+}
+
+func decompressChunk(codec string, data []byte) ([]byte, error) {
+    switch codec {
+    case "", CodecNone:
+        return data, nil
+    case CodecZstd:
+        return zstdDecoder.DecodeAll(data, nil)
+    case CodecGzip:
+        zr, err := gzip.NewReader(bytes.NewReader(data))
+        if err != nil {
+            return nil, err
+        }
+        defer zr.Close()
+        return io.ReadAll(zr)
+    default:
+        return nil, fmt.Errorf("unknown codec: %s", codec)
+    }
+}
@@ -0,0 +1,82 @@
+package internal
+
+import (
+    "bytes"
+    "strings"
+    "testing"
+)
+
+func TestCompressChunkRoundTrip(t *testing.T) {
+    text := []byte(strings.Repeat("the quick brown fox jumps over the lazy dog\n", 2000))
+    random := randomBytes(3, 64<<10)
+
+    tests := []struct {
+        name      string
+        codec     string
+        data      []byte
+        wantCodec string
+    }{
+        {"none", CodecNone, text, CodecNone},
+        {"gzip text", CodecGzip, text, CodecGzip},
+        {"zstd text", CodecZstd, text, CodecZstd},
+        {"gzip random falls back", CodecGzip, random, CodecNone},
+        {"zstd random falls back", CodecZstd, random, CodecNone},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            stored, codec, err := compressChunk(tt.codec, tt.data)
+            if err != nil {
+                t.Fatal(err)
+            }
+            if codec != tt.wantCodec {
+                t.Fatalf("codec = %s, want %s", codec, tt.wantCodec)
+            }
+            if codec != CodecNone && len(stored) >= len(tt.data) {
+                t.Errorf("compressed %d bytes to %d", len(tt.data), len(stored))
+            }
+
+            got, err := decompressChunk(codec, stored)
+            if err != nil {
+                t.Fatal(err)
+            }
+            if !bytes.Equal(got, tt.data) {
+                t.Error("round trip changed the data")
+            }
+        })
+    }
+}
+
+func TestDecompressChunkErrors(t *testing.T) {
+    if _, _, err := compressChunk("brotli", []byte("x")); err == nil {
+        t.Error("compressChunk accepted an unknown codec")
+    }
+    if _, err := decompressChunk("brotli", []byte("x")); err == nil {
+        t.Error("decompressChunk accepted an unknown codec")
+    }
+    for _, codec := range []string{CodecGzip, CodecZstd} {
+        if _, err := decompressChunk(codec, []byte("not compressed at all")); err == nil {
+            t.Errorf("%s decoded garbage", codec)
+        }
+    }
+    // Chunks stored before compression existed have no codec recorded
+    if got, err := decompressChunk("", []byte("raw")); err != nil || string(got) != "raw" {
+        t.Errorf("legacy chunk = %q, %v", got, err)
+    }
+}
+
+func TestCodecForMime(t *testing.T) {
+    t.Setenv("COMPRESSION_CODEC", "gzip")
+    tests := map[string]string{
+        "text/plain; charset=utf-8": CodecGzip,
+        "application/json":          CodecGzip,
+        "image/jpeg":                CodecNone,
+        "video/mp4":                 CodecNone,
+        "application/zip":           CodecNone,
+        "":                          CodecGzip,
+    }
+    for mimeType, want := range tests {
+        if got := codecForMime(mimeType); got != want {
+            t.Errorf("codecForMime(%q) = %s, want %s", mimeType, got, want)
+        }
+    }
+}
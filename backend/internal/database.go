@@ -1,6 +1,8 @@
 package internal
 
 import (
+    "bytes"
+    "fmt"
     "log"
     "os"
     
@@ -24,32 +26,69 @@ func ConnectDB() *gorm.DB {
         log.Fatal("Failed to connect to database:", err)
     }
     
+    // Accounts from before email verification existed are trusted as they are
+    backfillVerified := db.Migrator().HasTable(&User{}) && !db.Migrator().HasColumn(&User{}, "email_verified")
+    
     // Auto-migrate all models
     err = db.AutoMigrate(
         &User{},
         &DataBlock{},
+        &Chunk{},
+        &BlockChunk{},
         &TrieNode{},
         &FileNode{},
         &DirNode{},
         &SymLinkNode{},
         &Share{},
         &AuditLog{},
+        &UploadSession{},
+        &TrashEntry{},
+        &FileVersion{},
+        &Snapshot{},
+        &SnapshotEntry{},
+        &DocumentText{},
+        &Tag{},
+        &NodeTag{},
+        &RefreshToken{},
+        &RevokedToken{},
+        &APIKey{},
+        &RecoveryCode{},
+        &Setting{},
+        &AccountToken{},
     )
     
     if err != nil {
         log.Fatal("Failed to migrate database:", err)
     }
     
+    // Chunks written before compression existed are stored raw
+    db.Model(&Chunk{}).Where("stored_size = 0 AND size > 0").Update("stored_size", gorm.Expr("size"))
+    
+    // Files uploaded before versioning last changed when they were created
+    db.Model(&FileNode{}).Where("modified_at IS NULL").Update("modified_at", gorm.Expr("created_at"))
+    
+    if backfillVerified {
+        db.Model(&User{}).Where("1 = 1").Update("email_verified", true)
+    }
+    
+    // AutoMigrate can't declare GIN indexes
+    db.Exec("CREATE INDEX IF NOT EXISTS idx_document_texts_search ON document_texts USING GIN (search_vector)")
+    
+    if err := migrateLegacyTags(db); err != nil {
+        log.Println("Warning: failed to migrate file tags:", err)
+    }
+    
     // Create admin user if not exists
     var adminUser User
     if err := db.Where("role = ?", "admin").First(&adminUser).Error; err != nil {
         hashedPassword, _ := bcrypt.GenerateFromPassword([]byte("admin123"), bcrypt.DefaultCost)
         admin := &User{
-            Username:  "admin",
-            Email:     "admin@filevault.com",
-            Password:  string(hashedPassword),
-            Role:      "admin",
-            QuotaMax:  1024 * 1024 * 1024, // 1GB for admin
+            Username:      "admin",
+            Email:         "admin@filevault.com",
+            Password:      string(hashedPassword),
+            Role:          "admin",
+            QuotaMax:      1024 * 1024 * 1024, // 1GB for admin
+            EmailVerified: true,
         }
         db.Create(admin)
         log.Println("Admin user created: admin@filevault.com / admin123")
@@ -57,3 +96,45 @@ func ConnectDB() *gorm.DB {
     
     return db
 }
+
+// MigrateInlineBlocks moves legacy data_blocks.data contents into the blob store
+func MigrateInlineBlocks(db *gorm.DB, blobs BlobStore) error {
+    if !db.Migrator().HasColumn(&DataBlock{}, "data") {
+        return nil
+    }
+    
+    // Blocks can be large, so only a few are held in memory at a time
+    const batchSize = 20
+    moved := 0
+    lastID := uint(0)
+    for {
+        var rows []struct {
+            ID   uint
+            Hash string
+            Data []byte
+        }
+        err := db.Table("data_blocks").Select("id, hash, data").
+            Where("data IS NOT NULL AND id > ?", lastID).Order("id").Limit(batchSize).Find(&rows).Error
+        if err != nil {
+            return err
+        }
+        if len(rows) == 0 {
+            break
+        }
+        
+        for _, row := range rows {
+            if _, err := blobs.Put(row.Hash, bytes.NewReader(row.Data)); err != nil {
+                return fmt.Errorf("migrating block %d: %w", row.ID, err)
+            }
+            db.Table("data_blocks").Where("id = ?", row.ID).Update("data", nil)
+            lastID = row.ID
+        }
+        moved += len(rows)
+    }
+    
+    if moved > 0 {
+        log.Printf("Moved %d inline data blocks into blob store", moved)
+    }
+    
+    return db.Migrator().DropColumn(&DataBlock{}, "data")
+}
@@ -0,0 +1,195 @@
+package internal
+
+import (
+    "crypto/aes"
+    "crypto/cipher"
+    "crypto/rand"
+    "crypto/sha256"
+    "encoding/base64"
+    "encoding/hex"
+    "errors"
+    "fmt"
+    "os"
+    "strings"
+
+    "gorm.io/gorm"
+)
+
+// Envelope encryption: every chunk is sealed with its own AES-256-GCM data key,
+// and only that data key (wrapped by the master key) is stored in the database.
+// Rotating the master key re-wraps data keys; chunk contents are never rewritten.
+
+var ErrUnknownMasterKey = errors.New("chunk is wrapped by a master key that is not configured")
+
+// KeyRing holds the current master key plus retired ones still needed to unwrap
+type KeyRing struct {
+    CurrentID string
+    keys      map[string][]byte
+}
+
+// LoadKeyRingFromEnv reads MASTER_KEY (or MASTER_KEY_FILE) and optional
+// PREVIOUS_MASTER_KEYS (or PREVIOUS_MASTER_KEYS_FILE), all base64-encoded 32-byte keys.
+// Returns nil when no master key is configured, which leaves encryption off; that is an
+// error when ENCRYPTION_AT_REST=true asks for encryption.
+func LoadKeyRingFromEnv() (*KeyRing, error) {
+    current, err := readKeyConfig("MASTER_KEY")
+    if err != nil {
+        return nil, err
+    }
+    if current == "" {
+        if os.Getenv("ENCRYPTION_AT_REST") == "true" {
+            return nil, errors.New("ENCRYPTION_AT_REST is on but MASTER_KEY is not set (generate one with `openssl rand -base64 32`)")
+        }
+        return nil, nil
+    }
+
+    ring := &KeyRing{keys: make(map[string][]byte)}
+    ring.CurrentID, err = ring.add(current)
+    if err != nil {
+        return nil, fmt.Errorf("MASTER_KEY: %w", err)
+    }
+
+    previous, err := readKeyConfig("PREVIOUS_MASTER_KEYS")
+    if err != nil {
+        return nil, err
+    }
+    for _, encoded := range strings.Split(previous, ",") {
+        if encoded = strings.TrimSpace(encoded); encoded == "" {
+            continue
+        }
+        if _, err := ring.add(encoded); err != nil {
+            return nil, fmt.Errorf("PREVIOUS_MASTER_KEYS: %w", err)
+        }
+    }
+
+    return ring, nil
+}
+
+func readKeyConfig(name string) (string, error) {
+    if path := os.Getenv(name + "_FILE"); path != "" {
+        data, err := os.ReadFile(path)
+        if err != nil {
+            return "", err
+        }
+        return strings.TrimSpace(string(data)), nil
+    }
+    return os.Getenv(name), nil
+}
+
+// add registers a key under its fingerprint, so wrapped keys record which master sealed them
+func (k *KeyRing) add(encoded string) (string, error) {
+    key, err := base64.StdEncoding.DecodeString(encoded)
+    if err != nil {
+        return "", err
+    }
+    if len(key) != 32 {
+        return "", errors.New("master key must be 32 bytes")
+    }
+
+    sum := sha256.Sum256(key)
+    id := hex.EncodeToString(sum[:8])
+    k.keys[id] = key
+    return id, nil
+}
+
+// NewDataKey draws a fresh random data key for one stored chunk
+func NewDataKey() ([]byte, error) {
+    key := make([]byte, 32)
+    if _, err := rand.Read(key); err != nil {
+        return nil, err
+    }
+    return key, nil
+}
+
+// Wrap seals a data key with the current master key
+func (k *KeyRing) Wrap(dataKey []byte) ([]byte, string, error) {
+    sealed, err := sealGCM(k.keys[k.CurrentID], dataKey, []byte("filevault-dek"))
+    return sealed, k.CurrentID, err
+}
+
+// Unwrap opens a data key sealed by any master key in the ring
+func (k *KeyRing) Unwrap(wrapped []byte, keyID string) ([]byte, error) {
+    master, ok := k.keys[keyID]
+    if !ok {
+        return nil, ErrUnknownMasterKey
+    }
+    return openGCM(master, wrapped, []byte("filevault-dek"))
+}
+
+// encryptChunk seals stored chunk bytes under a random nonce, binding them to the chunk hash
+func encryptChunk(dataKey []byte, hash string, data []byte) ([]byte, error) {
+    return sealGCM(dataKey, data, []byte(hash))
+}
+
+func decryptChunk(dataKey []byte, hash string, data []byte) ([]byte, error) {
+    return openGCM(dataKey, data, []byte(hash))
+}
+
+// sealGCM returns nonce || ciphertext under a fresh random nonce
+func sealGCM(key, plaintext, additionalData []byte) ([]byte, error) {
+    block, err := aes.NewCipher(key)
+    if err != nil {
+        return nil, err
+    }
+    gcm, err := cipher.NewGCM(block)
+    if err != nil {
+        return nil, err
+    }
+
+    nonce := make([]byte, gcm.NonceSize())
+    if _, err := rand.Read(nonce); err != nil {
+        return nil, err
+    }
+    return gcm.Seal(append([]byte{}, nonce...), nonce, plaintext, additionalData), nil
+}
+
+func openGCM(key, sealed, additionalData []byte) ([]byte, error) {
+    block, err := aes.NewCipher(key)
+    if err != nil {
+        return nil, err
+    }
+    gcm, err := cipher.NewGCM(block)
+    if err != nil {
+        return nil, err
+    }
+
+    if len(sealed) < gcm.NonceSize() {
+        return nil, errors.New("ciphertext too short")
+    }
+    nonce, ciphertext := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+    return gcm.Open(nil, nonce, ciphertext, additionalData)
+}
+
+// RotateMasterKey re-wraps every data key not sealed by the current master key
+func RotateMasterKey(db *gorm.DB, keys *KeyRing) (int, error) {
+    if keys == nil {
+        return 0, errors.New("MASTER_KEY is not configured")
+    }
+
+    rotated := 0
+    var chunks []Chunk
+    result := db.Where("key_id <> '' AND key_id <> ?", keys.CurrentID).FindInBatches(&chunks, 500, func(tx *gorm.DB, batch int) error {
+        for _, chunk := range chunks {
+            dataKey, err := keys.Unwrap(chunk.WrappedKey, chunk.KeyID)
+            if err != nil {
+                return fmt.Errorf("chunk %d (key %s): %w", chunk.ID, chunk.KeyID, err)
+            }
+            wrapped, keyID, err := keys.Wrap(dataKey)
+            if err != nil {
+                return err
+            }
+
+            err = tx.Model(&Chunk{}).Where("id = ?", chunk.ID).Updates(map[string]interface{}{
+                "wrapped_key": wrapped,
+                "key_id":      keyID,
+            }).Error
+            if err != nil {
+                return err
+            }
+            rotated++
+        }
+        return nil
+    })
+
+    return rotated, result.Error
+}
@@ -0,0 +1,176 @@
+package internal
+
+import (
+    "bytes"
+    "crypto/rand"
+    "encoding/base64"
+    "testing"
+)
+
+func newMasterKey(t *testing.T) string {
+    t.Helper()
+    key := make([]byte, 32)
+    if _, err := rand.Read(key); err != nil {
+        t.Fatal(err)
+    }
+    return base64.StdEncoding.EncodeToString(key)
+}
+
+func testKeyRing(t *testing.T, current string, previous ...string) *KeyRing {
+    t.Helper()
+    ring := &KeyRing{keys: make(map[string][]byte)}
+    var err error
+    if ring.CurrentID, err = ring.add(current); err != nil {
+        t.Fatal(err)
+    }
+    for _, key := range previous {
+        if _, err := ring.add(key); err != nil {
+            t.Fatal(err)
+        }
+    }
+    return ring
+}
+
+func TestEncryptChunkRoundTrip(t *testing.T) {
+    dataKey, err := NewDataKey()
+    if err != nil {
+        t.Fatal(err)
+    }
+    hash := "abc123"
+    plaintext := []byte("chunk contents")
+
+    sealed, err := encryptChunk(dataKey, hash, plaintext)
+    if err != nil {
+        t.Fatal(err)
+    }
+    got, err := decryptChunk(dataKey, hash, sealed)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !bytes.Equal(got, plaintext) {
+        t.Fatalf("decrypted %q, want %q", got, plaintext)
+    }
+
+    // Nonces are random, so sealing the same bytes twice never repeats a ciphertext
+    again, _ := encryptChunk(dataKey, hash, plaintext)
+    if bytes.Equal(again, sealed) {
+        t.Error("two encryptions of one plaintext produced the same ciphertext")
+    }
+}
+
+func TestDecryptChunkRejectsTampering(t *testing.T) {
+    dataKey, _ := NewDataKey()
+    otherKey, _ := NewDataKey()
+    sealed, err := encryptChunk(dataKey, "hash-a", []byte("chunk contents"))
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    flip := func(i int) []byte {
+        tampered := append([]byte{}, sealed...)
+        tampered[i] ^= 0x01
+        return tampered
+    }
+    tests := []struct {
+        name string
+        key  []byte
+        hash string
+        data []byte
+    }{
+        {"flipped nonce", dataKey, "hash-a", flip(0)},
+        {"flipped ciphertext", dataKey, "hash-a", flip(len(sealed) / 2)},
+        {"flipped tag", dataKey, "hash-a", flip(len(sealed) - 1)},
+        {"truncated", dataKey, "hash-a", sealed[:len(sealed)-1]},
+        {"too short", dataKey, "hash-a", sealed[:4]},
+        {"other chunk's hash", dataKey, "hash-b", sealed},
+        {"wrong key", otherKey, "hash-a", sealed},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            if _, err := decryptChunk(tt.key, tt.hash, tt.data); err == nil {
+                t.Error("tampered chunk decrypted")
+            }
+        })
+    }
+}
+
+func TestDataKeysAreUnique(t *testing.T) {
+    a, _ := NewDataKey()
+    b, _ := NewDataKey()
+    if len(a) != 32 || bytes.Equal(a, b) {
+        t.Errorf("data keys %x and %x", a, b)
+    }
+}
+
+func TestWrapUnwrapAcrossRotation(t *testing.T) {
+    oldKey, newKey := newMasterKey(t), newMasterKey(t)
+    oldRing := testKeyRing(t, oldKey)
+    dataKey, _ := NewDataKey()
+
+    wrapped, keyID, err := oldRing.Wrap(dataKey)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    // After rotation the old master key still unwraps what it sealed
+    rotated := testKeyRing(t, newKey, oldKey)
+    got, err := rotated.Unwrap(wrapped, keyID)
+    if err != nil || !bytes.Equal(got, dataKey) {
+        t.Fatalf("Unwrap after rotation = %x, %v", got, err)
+    }
+    rewrapped, newID, err := rotated.Wrap(got)
+    if err != nil || newID == keyID {
+        t.Fatalf("Wrap after rotation used key %s, %v", newID, err)
+    }
+
+    // Without the old key the old wrapping can't be opened, but the new one can
+    newOnly := testKeyRing(t, newKey)
+    if _, err := newOnly.Unwrap(wrapped, keyID); err != ErrUnknownMasterKey {
+        t.Errorf("Unwrap with retired key = %v, want ErrUnknownMasterKey", err)
+    }
+    if got, err := newOnly.Unwrap(rewrapped, newID); err != nil || !bytes.Equal(got, dataKey) {
+        t.Errorf("Unwrap of rewrapped key = %x, %v", got, err)
+    }
+
+    tampered := append([]byte{}, wrapped...)
+    tampered[len(tampered)-1] ^= 0x01
+    if _, err := oldRing.Unwrap(tampered, keyID); err == nil {
+        t.Error("tampered wrapped key unwrapped")
+    }
+}
+
+func TestLoadKeyRingFromEnv(t *testing.T) {
+    key := newMasterKey(t)
+    tests := []struct {
+        name       string
+        encryption string
+        master     string
+        previous   string
+        wantRing   bool
+        wantErr    bool
+    }{
+        {"encryption off without key", "", "", "", false, false},
+        {"encryption on without key", "true", "", "", false, true},
+        {"key enables encryption", "", key, "", true, false},
+        {"invalid base64", "", "not base64!", "", false, true},
+        {"wrong length", "", base64.StdEncoding.EncodeToString([]byte("short")), "", false, true},
+        {"invalid previous key", "true", key, "bad", false, true},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            t.Setenv("ENCRYPTION_AT_REST", tt.encryption)
+            t.Setenv("MASTER_KEY", tt.master)
+            t.Setenv("MASTER_KEY_FILE", "")
+            t.Setenv("PREVIOUS_MASTER_KEYS", tt.previous)
+            t.Setenv("PREVIOUS_MASTER_KEYS_FILE", "")
+
+            ring, err := LoadKeyRingFromEnv()
+            if (err != nil) != tt.wantErr {
+                t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+            }
+            if (ring != nil) != tt.wantRing {
+                t.Errorf("ring = %v, wantRing %v", ring, tt.wantRing)
+            }
+        })
+    }
+}
@@ -0,0 +1,302 @@
+package internal
+
+import (
+    "archive/tar"
+    "archive/zip"
+    "compress/gzip"
+    "errors"
+    "fmt"
+    "io"
+    "mime"
+    "os"
+    "path"
+    "strconv"
+    "strings"
+)
+
+// Archive extraction defaults; EXTRACT_MAX_SIZE, EXTRACT_MAX_RATIO and
+// EXTRACT_MAX_ENTRIES override them
+const (
+    defaultExtractMaxSize    = 4 << 30
+    defaultExtractMaxRatio   = 100
+    defaultExtractMaxEntries = 10000
+)
+
+var ErrArchiveTooLarge = errors.New("archive expands beyond the extraction limits")
+var ErrUnsupportedArchive = errors.New("unsupported archive format")
+
+// extractLimits bounds what one archive may expand to, against zip bombs
+type extractLimits struct {
+    MaxSize    int64 // Total extracted bytes
+    MaxRatio   int64 // Total extracted bytes per archive byte
+    MaxEntries int
+}
+
+func extractLimitsFromEnv() extractLimits {
+    limits := extractLimits{
+        MaxSize:    defaultExtractMaxSize,
+        MaxRatio:   defaultExtractMaxRatio,
+        MaxEntries: defaultExtractMaxEntries,
+    }
+    if n, err := strconv.ParseInt(os.Getenv("EXTRACT_MAX_SIZE"), 10, 64); err == nil && n > 0 {
+        limits.MaxSize = n
+    }
+    if n, err := strconv.ParseInt(os.Getenv("EXTRACT_MAX_RATIO"), 10, 64); err == nil && n > 0 {
+        limits.MaxRatio = n
+    }
+    if n, err := strconv.Atoi(os.Getenv("EXTRACT_MAX_ENTRIES")); err == nil && n > 0 {
+        limits.MaxEntries = n
+    }
+    return limits
+}
+
+// IsArchiveName reports whether ExtractArchive can unpack a file with this name
+func IsArchiveName(filename string) bool {
+    return archiveFormat(filename) != ""
+}
+
+func archiveFormat(filename string) string {
+    name := strings.ToLower(filename)
+    switch {
+    case strings.HasSuffix(name, ".zip"):
+        return "zip"
+    case strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"):
+        return "tar.gz"
+    case strings.HasSuffix(name, ".tar"):
+        return "tar"
+    default:
+        return ""
+    }
+}
+
+// ExtractArchive - Unpacks a zip or tar(.gz) into dirPath, storing every file through
+// ProcessFileUpload so entries dedupe and count against the quota like uploads.
+// Unsafe or unsupported entries are skipped and reported; exceeding the quota or the
+// extraction limits stops extraction, keeping what was already stored.
+func (fs *FileSystem) ExtractArchive(userID uint, filename string, content io.Reader, dirPath string, opts UploadOptions) ([]FileNode, []string, error) {
+    format := archiveFormat(filename)
+    if format == "" {
+        return nil, nil, ErrUnsupportedArchive
+    }
+    dirParts := fs.SplitPath(dirPath)
+    if dirParts == nil {
+        return nil, nil, errors.New("invalid path: reserved characters not allowed")
+    }
+
+    var user User
+    if err := fs.DB.First(&user, userID).Error; err != nil {
+        return nil, nil, err
+    }
+
+    // Zip needs random access, so spool the archive itself first
+    staged, err := fs.stageUpload(content, user.QuotaMax-user.QuotaUsed)
+    if err != nil {
+        return nil, nil, err
+    }
+    defer staged.Remove()
+
+    limits := extractLimitsFromEnv()
+    budget := limits.MaxSize
+    if byRatio := staged.Size * limits.MaxRatio; byRatio < budget {
+        budget = byRatio
+    }
+
+    x := &extraction{
+        fs:       fs,
+        userID:   userID,
+        dirParts: dirParts,
+        opts:     opts,
+        limits:   limits,
+        budget:   budget,
+    }
+
+    switch format {
+    case "zip":
+        err = x.extractZip(staged.File, staged.Size, user.QuotaMax-user.QuotaUsed)
+    case "tar.gz":
+        var gz *gzip.Reader
+        if gz, err = gzip.NewReader(staged.File); err == nil {
+            err = x.extractTar(gz)
+            gz.Close()
+        }
+    default:
+        err = x.extractTar(staged.File)
+    }
+
+    return x.files, x.skipped, err
+}
+
+// extraction is the state of one ExtractArchive call
+type extraction struct {
+    fs       *FileSystem
+    userID   uint
+    dirParts []string
+    opts     UploadOptions
+    limits   extractLimits
+    budget   int64 // Extracted bytes still allowed
+    entries  int
+    files    []FileNode
+    skipped  []string
+}
+
+func (x *extraction) extractZip(archive io.ReaderAt, size, quotaLeft int64) error {
+    zr, err := zip.NewReader(archive, size)
+    if err != nil {
+        return err
+    }
+
+    // Declared sizes can lie, so this only rejects honest bombs early;
+    // the budget reader enforces the limit on actual bytes
+    declared := uint64(0)
+    for _, f := range zr.File {
+        declared += f.UncompressedSize64
+    }
+    if len(zr.File) > x.limits.MaxEntries || declared > uint64(x.budget) {
+        return ErrArchiveTooLarge
+    }
+    if declared > uint64(quotaLeft) {
+        return ErrQuotaExceeded
+    }
+
+    for _, f := range zr.File {
+        mode := f.Mode()
+        switch {
+        case mode.IsDir():
+            if err := x.dir(f.Name); err != nil {
+                return err
+            }
+        case mode.IsRegular():
+            rc, err := f.Open()
+            if err != nil {
+                x.skip(f.Name, err.Error())
+                continue
+            }
+            err = x.file(f.Name, &budgetReader{r: rc, budget: &x.budget})
+            rc.Close()
+            if err != nil {
+                return err
+            }
+        default:
+            x.skip(f.Name, "unsupported entry type")
+        }
+    }
+    return nil
+}
+
+// extractTar budgets the whole (decompressed) stream rather than each entry: skipping
+// an unsupported entry still has to read through it
+func (x *extraction) extractTar(r io.Reader) error {
+    tr := tar.NewReader(&budgetReader{r: r, budget: &x.budget})
+    for {
+        header, err := tr.Next()
+        if err == io.EOF {
+            return nil
+        }
+        if err != nil {
+            return err
+        }
+
+        switch header.Typeflag {
+        case tar.TypeDir:
+            err = x.dir(header.Name)
+        case tar.TypeReg:
+            err = x.file(header.Name, tr)
+        default:
+            x.skip(header.Name, "unsupported entry type")
+        }
+        if err != nil {
+            return err
+        }
+    }
+}
+
+// dir creates a directory entry; only limit errors are returned
+func (x *extraction) dir(name string) error {
+    if err := x.countEntry(); err != nil {
+        return err
+    }
+    fullPath, ok := x.entryPath(name)
+    if !ok {
+        return nil
+    }
+    if _, err := x.fs.Insert(fullPath, false, x.userID); err != nil {
+        x.skip(name, err.Error())
+    }
+    return nil
+}
+
+// file stores a file entry read through the extraction budget; only quota and limit
+// errors are returned
+func (x *extraction) file(name string, content io.Reader) error {
+    if err := x.countEntry(); err != nil {
+        return err
+    }
+    fullPath, ok := x.entryPath(name)
+    if !ok {
+        return nil
+    }
+
+    dir, base := path.Split(fullPath)
+    fileNode, err := x.fs.ProcessFileUpload(x.userID, base, mime.TypeByExtension(path.Ext(base)), content, dir, x.opts)
+    if errors.Is(err, ErrQuotaExceeded) || errors.Is(err, ErrArchiveTooLarge) {
+        return err
+    }
+    if err != nil {
+        x.skip(name, err.Error())
+        return nil
+    }
+
+    x.files = append(x.files, *fileNode)
+    return nil
+}
+
+// entryPath maps an archive entry name into the target directory, rejecting
+// zip-slip names (absolute, backslashed or with "." / ".." segments) via SplitPath
+func (x *extraction) entryPath(name string) (string, bool) {
+    cleaned := strings.TrimSuffix(name, "/")
+    // tar's "./" prefix is harmless; the archive root itself has nothing to create
+    for strings.HasPrefix(cleaned, "./") {
+        cleaned = cleaned[2:]
+    }
+    if cleaned == "" || cleaned == "." {
+        return "", false
+    }
+    if strings.HasPrefix(cleaned, "/") || strings.Contains(cleaned, "\\") {
+        x.skip(name, "unsafe path")
+        return "", false
+    }
+
+    parts := x.fs.SplitPath(cleaned)
+    if len(parts) == 0 {
+        x.skip(name, "unsafe path")
+        return "", false
+    }
+    return joinPath(append(append([]string{}, x.dirParts...), parts...)), true
+}
+
+func (x *extraction) countEntry() error {
+    x.entries++
+    if x.entries > x.limits.MaxEntries {
+        return ErrArchiveTooLarge
+    }
+    return nil
+}
+
+func (x *extraction) skip(name, reason string) {
+    x.skipped = append(x.skipped, fmt.Sprintf("%s: %s", name, reason))
+}
+
+// budgetReader fails with ErrArchiveTooLarge once an archive has expanded past its budget
+type budgetReader struct {
+    r      io.Reader
+    budget *int64
+}
+
+func (b *budgetReader) Read(p []byte) (int, error) {
+    n, err := b.r.Read(p)
+    *b.budget -= int64(n)
+    if *b.budget < 0 {
+        return n, ErrArchiveTooLarge
+    }
+    return n, err
+}
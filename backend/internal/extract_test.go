@@ -0,0 +1,95 @@
+package internal
+
+import (
+    "archive/tar"
+    "bytes"
+    "compress/gzip"
+    "errors"
+    "testing"
+)
+
+func TestEntryPathRejectsZipSlip(t *testing.T) {
+    tests := []struct {
+        name    string
+        want    string // "" when the entry is dropped
+        skipped bool   // Whether it is reported as unsafe
+    }{
+        {"a.txt", "/dest/a.txt", false},
+        {"dir/sub/b.txt", "/dest/dir/sub/b.txt", false},
+        {"dir/", "/dest/dir", false},
+        {"./dir/c.txt", "/dest/dir/c.txt", false},
+        {"././d.txt", "/dest/d.txt", false},
+        {"Über/ファイル.txt", "/dest/Über/ファイル.txt", false},
+        {"./", "", false},
+        {".", "", false},
+        {"../evil.txt", "", true},
+        {"dir/../../evil.txt", "", true},
+        {"dir/./x.txt", "", true},
+        {"/etc/passwd", "", true},
+        {"..\\evil.txt", "", true},
+        {"dir\\evil.txt", "", true},
+        {"dir//x.txt", "", true},
+        {"..", "", true},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            x := &extraction{fs: &FileSystem{}, dirParts: []string{"dest"}}
+            got, ok := x.entryPath(tt.name)
+            if ok != (tt.want != "") || got != tt.want {
+                t.Errorf("entryPath(%q) = %q, %v; want %q", tt.name, got, ok, tt.want)
+            }
+            if skipped := len(x.skipped) > 0; skipped != tt.skipped {
+                t.Errorf("entryPath(%q) skipped = %v, want %v", tt.name, x.skipped, tt.skipped)
+            }
+        })
+    }
+}
+
+func TestBudgetReaderStopsAtLimit(t *testing.T) {
+    budget := int64(10)
+    r := &budgetReader{r: repeatReader{}, budget: &budget}
+    buf := make([]byte, 4)
+    var err error
+    read := 0
+    for err == nil && read < 100 {
+        var n int
+        n, err = r.Read(buf)
+        read += n
+    }
+    if err != ErrArchiveTooLarge {
+        t.Errorf("err = %v after %d bytes, want ErrArchiveTooLarge", err, read)
+    }
+}
+
+// repeatReader never ends, like a decompression bomb
+type repeatReader struct{}
+
+func (repeatReader) Read(p []byte) (int, error) {
+    return len(p), nil
+}
+
+// Entries that are skipped still have to be decompressed to reach the next header,
+// so they count against the budget too
+func TestExtractTarBudgetsSkippedEntries(t *testing.T) {
+    var archive bytes.Buffer
+    gz := gzip.NewWriter(&archive)
+    tw := tar.NewWriter(gz)
+    size := int64(1 << 20)
+    if err := tw.WriteHeader(&tar.Header{Name: "unsupported", Typeflag: 'Z', Size: size, Mode: 0o644}); err != nil {
+        t.Fatal(err)
+    }
+    if _, err := tw.Write(make([]byte, size)); err != nil {
+        t.Fatal(err)
+    }
+    tw.Close()
+    gz.Close()
+
+    zr, err := gzip.NewReader(&archive)
+    if err != nil {
+        t.Fatal(err)
+    }
+    x := &extraction{fs: &FileSystem{}, limits: extractLimits{MaxEntries: 10}, budget: 64 << 10}
+    if err := x.extractTar(zr); !errors.Is(err, ErrArchiveTooLarge) {
+        t.Errorf("err = %v, want ErrArchiveTooLarge", err)
+    }
+}
@@ -3,13 +3,16 @@ package internal
 import (
     "encoding/json"
     "fmt"
+    "io"
+    "log"
     "net/http"
     "os"
+    "path/filepath"
     "strconv"
+    "strings"
     "time"
     
     "github.com/gorilla/mux"
-    "github.com/golang-jwt/jwt/v5"
     "golang.org/x/crypto/bcrypt"
     "gorm.io/gorm"
     
@@ -20,6 +23,17 @@ type App struct {
     DB         *gorm.DB
     JWTSecret  string
     FileSystem *FileSystem
+    Blobs      BlobStore
+    Keys       *KeyRing
+    UploadDir  string // Partial resumable uploads
+    Mailer     Mailer
+    PublicURL  string // Frontend base URL for links in emails
+    
+    TrashRetention  time.Duration
+    AccessTokenTTL  time.Duration
+    RefreshTokenTTL time.Duration
+    
+    RequireVerifiedEmail bool // Unverified accounts can't use the API beyond their profile
 }
 
 func NewApp() *App {
@@ -29,9 +43,55 @@ func NewApp() *App {
         jwtSecret = "default-secret-change-in-production"
     }
     
+    blobs, err := NewBlobStoreFromEnv()
+    if err != nil {
+        log.Fatal("Failed to initialize blob store:", err)
+    }
+    if err := MigrateInlineBlocks(db, blobs); err != nil {
+        log.Fatal("Failed to migrate inline data blocks:", err)
+    }
+    
+    keys, err := LoadKeyRingFromEnv()
+    if err != nil {
+        log.Fatal("Failed to load master key:", err)
+    }
+    if keys == nil {
+        // Without the key, chunks already stored encrypted could never be read back
+        var encrypted int64
+        db.Model(&Chunk{}).Where("key_id <> ''").Count(&encrypted)
+        if encrypted > 0 {
+            log.Fatal("MASTER_KEY is not set but stored data is encrypted")
+        }
+        log.Println("Warning: MASTER_KEY not set, new data will be stored unencrypted")
+    } else {
+        // Text indexed before encryption was enabled; search keeps working from the vectors
+        db.Model(&DocumentText{}).Where("content <> ''").Update("content", "")
+    }
+    
+    uploadDir := os.Getenv("TUS_UPLOAD_DIR")
+    if uploadDir == "" {
+        uploadDir = filepath.Join("uploads", "tus")
+    }
+    
+    mailer, err := NewMailerFromEnv()
+    if err != nil {
+        log.Fatal("Failed to initialize mailer:", err)
+    }
+    
     app := &App{
         DB:        db,
         JWTSecret: jwtSecret,
+        Blobs:     blobs,
+        Keys:      keys,
+        UploadDir: uploadDir,
+        Mailer:    mailer,
+        PublicURL: publicURLFromEnv(),
+        
+        TrashRetention:  trashRetentionFromEnv(),
+        AccessTokenTTL:  accessTokenTTLFromEnv(),
+        RefreshTokenTTL: refreshTokenTTLFromEnv(),
+        
+        RequireVerifiedEmail: requireVerifiedEmailFromEnv(),
     }
     return app
 }
@@ -62,13 +122,13 @@ func (app *App) Register(w http.ResponseWriter, r *http.Request) {
         return
     }
     
-    token := app.generateJWT(user.ID)
+    go func(user User) {
+        if err := app.sendAccountMail(&user, PurposeVerifyEmail); err != nil {
+            log.Printf("Failed to send verification email to user %d: %v", user.ID, err)
+        }
+    }(*user)
     
-    w.Header().Set("Content-Type", "application/json")
-    json.NewEncoder(w).Encode(map[string]interface{}{
-        "token": token,
-        "user":  user,
-    })
+    app.writeSession(w, r, user)
 }
 
 func (app *App) Login(w http.ResponseWriter, r *http.Request) {
@@ -90,38 +150,125 @@ func (app *App) Login(w http.ResponseWriter, r *http.Request) {
         return
     }
     
-    token := app.generateJWT(user.ID)
+    // With 2FA the password only earns a challenge, completed at /api/auth/2fa
+    if user.TOTPEnabled {
+        challenge, err := app.issueChallenge(user.ID)
+        if err != nil {
+            http.Error(w, "Failed to start login", http.StatusInternalServerError)
+            return
+        }
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(map[string]interface{}{
+            "two_factor_required": true,
+            "challenge_token":     challenge,
+        })
+        return
+    }
     
-    w.Header().Set("Content-Type", "application/json")
-    json.NewEncoder(w).Encode(map[string]interface{}{
-        "token": token,
-        "user":  user,
-    })
+    app.writeSession(w, r, &user)
 }
 
 // File handlers
 func (app *App) UploadFile(w http.ResponseWriter, r *http.Request) {
     userID := app.getUserID(r)
-    fs := NewFileSystem(app.DB, userID)
+    fs := NewFileSystem(app.DB, app.Blobs, app.Keys, userID)
     
-    r.ParseMultipartForm(32 << 20) // 32MB
+    // Stream parts instead of ParseMultipartForm so large files never sit in memory.
+    // The "directory", "versioning", "extract", "metadata" (a JSON object) and
+    // "meta.<key>" fields must precede the files they apply to (or use ?directory=,
+    // ?versioning=true and ?extract=true).
+    reader, err := r.MultipartReader()
+    if err != nil {
+        http.Error(w, "Expected multipart/form-data", http.StatusBadRequest)
+        return
+    }
     
-    files := r.MultipartForm.File["files"]
-    dirPath := r.FormValue("directory")
+    dirPath := r.URL.Query().Get("directory")
     if dirPath == "" {
         dirPath = "/"
     }
+    opts := UploadOptions{Versioning: r.URL.Query().Get("versioning") == "true"}
+    extract := r.URL.Query().Get("extract") == "true"
     
     var uploadedFiles []FileNode
     var errors []string
+    quotaExceeded := false
     
-    for _, fileHeader := range files {
-        file, err := fs.ProcessFileUpload(userID, fileHeader, dirPath)
+    for {
+        part, err := reader.NextPart()
+        if err == io.EOF {
+            break
+        }
         if err != nil {
-            errors = append(errors, fmt.Sprintf("%s: %s", fileHeader.Filename, err.Error()))
-            continue
+            errors = append(errors, err.Error())
+            break
+        }
+        
+        switch part.FormName() {
+        case "directory":
+            value, _ := io.ReadAll(io.LimitReader(part, 4096))
+            if len(value) > 0 {
+                dirPath = string(value)
+            }
+        case "versioning":
+            value, _ := io.ReadAll(io.LimitReader(part, 16))
+            opts.Versioning = string(value) == "true"
+        case "extract":
+            value, _ := io.ReadAll(io.LimitReader(part, 16))
+            extract = string(value) == "true"
+        case "metadata":
+            value, _ := io.ReadAll(io.LimitReader(part, maxMetadataSize+1))
+            metadata, err := parseMetadata(value)
+            if err != nil {
+                http.Error(w, err.Error(), http.StatusBadRequest)
+                return
+            }
+            opts.Metadata = metadata
+        case "files":
+            filename := part.FileName()
+            if err := validateFileName(filename); err != nil {
+                errors = append(errors, fmt.Sprintf("%q: %s", filename, err.Error()))
+                break
+            }
+            if extract && IsArchiveName(filename) {
+                // Archives become folders under dirPath instead of a single file
+                files, skipped, err := fs.ExtractArchive(userID, filename, part, dirPath, opts)
+                uploadedFiles = append(uploadedFiles, files...)
+                for _, reason := range skipped {
+                    errors = append(errors, fmt.Sprintf("%s: skipped %s", filename, reason))
+                }
+                if err != nil {
+                    errors = append(errors, fmt.Sprintf("%s: %s", filename, err.Error()))
+                    quotaExceeded = err == ErrQuotaExceeded
+                }
+                break
+            }
+            file, err := fs.ProcessFileUpload(userID, filename, part.Header.Get("Content-Type"), part, dirPath, opts)
+            if err != nil {
+                errors = append(errors, fmt.Sprintf("%s: %s", filename, err.Error()))
+                quotaExceeded = err == ErrQuotaExceeded
+            } else {
+                uploadedFiles = append(uploadedFiles, *file)
+            }
+        default:
+            // A fresh map each time, so files already uploaded keep what they were given
+            if key := strings.TrimPrefix(part.FormName(), "meta."); key != part.FormName() {
+                value, _ := io.ReadAll(io.LimitReader(part, maxMetadataSize+1))
+                opts.Metadata = opts.Metadata.merge(Metadata{key: string(value)})
+                if err := opts.Metadata.validate(); err != nil {
+                    http.Error(w, err.Error(), http.StatusBadRequest)
+                    return
+                }
+            }
         }
-        uploadedFiles = append(uploadedFiles, *file)
+        
+        // Stop reading the body rather than draining the rest of an over-quota request
+        if quotaExceeded {
+            part.Close()
+            w.Header().Set("Connection", "close")
+            break
+        }
+        part.Close()
     }
     
     w.Header().Set("Content-Type", "application/json")
@@ -134,8 +281,14 @@ func (app *App) UploadFile(w http.ResponseWriter, r *http.Request) {
 func (app *App) GetFiles(w http.ResponseWriter, r *http.Request) {
     userID := app.getUserID(r)
     
+    opts, err := parseListOptions(r, userID, "created_at", true)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    
     var files []FileNode
-    query := app.DB.Where("trie_node_id IN (SELECT id FROM trie_nodes WHERE owner_id = ? OR is_public = ?)", userID, true)
+    query := app.DB.Model(&FileNode{}).Where("trie_node_id IN (SELECT id FROM trie_nodes WHERE (owner_id = ? OR is_public = ?) AND trashed = ?)", userID, true, false)
     
     // Apply filters
     if name := r.URL.Query().Get("name"); name != "" {
@@ -144,9 +297,25 @@ func (app *App) GetFiles(w http.ResponseWriter, r *http.Request) {
     if mimeType := r.URL.Query().Get("mime_type"); mimeType != "" {
         query = query.Where("actual_mime_type LIKE ?", mimeType+"%")
     }
+    query = opts.filter(query, fileListColumns).Session(&gorm.Session{})
     
+    var page Page
+    query.Count(&page.Total)
+    
+    query, err = opts.page(query, fileListColumns)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
     query.Preload("TrieNode").Preload("DataBlock").Find(&files)
     
+    if len(files) > opts.Limit {
+        files = files[:opts.Limit]
+        last := files[len(files)-1]
+        page.NextCursor = opts.encodeCursor(last.ID, last.OriginalName, last.Size, last.CreatedAt, last.Downloads)
+    }
+    
+    writePageHeaders(w, page)
     w.Header().Set("Content-Type", "application/json")
     json.NewEncoder(w).Encode(files)
 }
@@ -157,7 +326,7 @@ func (app *App) DownloadFile(w http.ResponseWriter, r *http.Request) {
     userID := app.getUserID(r)
     
     var fileNode FileNode
-    if err := app.DB.Preload("TrieNode").Preload("DataBlock").First(&fileNode, fileID).Error; err != nil {
+    if err := app.DB.Preload("TrieNode").Preload("DataBlock").First(&fileNode, fileID).Error; err != nil || fileNode.TrieNode.Trashed {
         http.Error(w, "File not found", http.StatusNotFound)
         return
     }
@@ -168,13 +337,13 @@ func (app *App) DownloadFile(w http.ResponseWriter, r *http.Request) {
         return
     }
     
-    // Increment download counter
-    fileNode.Downloads++
-    app.DB.Save(&fileNode)
+    // Increment download counter (HEAD, 304s and resumed ranges don't count)
+    if isFullDownload(r, fileNode) {
+        fileNode.Downloads++
+        app.DB.Save(&fileNode)
+    }
     
-    w.Header().Set("Content-Type", fileNode.ActualMimeType)
-    w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", fileNode.OriginalName))
-    w.Write(fileNode.DataBlock.Data)
+    app.serveFile(w, r, fileNode)
 }
 
 func (app *App) DeleteFile(w http.ResponseWriter, r *http.Request) {
@@ -183,7 +352,7 @@ func (app *App) DeleteFile(w http.ResponseWriter, r *http.Request) {
     userID := app.getUserID(r)
     
     var fileNode FileNode
-    if err := app.DB.Preload("TrieNode").First(&fileNode, fileID).Error; err != nil {
+    if err := app.DB.Preload("TrieNode").First(&fileNode, fileID).Error; err != nil || fileNode.TrieNode.Trashed {
         http.Error(w, "File not found", http.StatusNotFound)
         return
     }
@@ -193,14 +362,27 @@ func (app *App) DeleteFile(w http.ResponseWriter, r *http.Request) {
         return
     }
     
-    fs := NewFileSystem(app.DB, userID)
-    if err := fs.DeleteFile(fileNode.TrieNode.Path, userID); err != nil {
+    fs := NewFileSystem(app.DB, app.Blobs, app.Keys, userID)
+    
+    // Deletes go to the trash unless ?permanent=true
+    if permanent, _ := strconv.ParseBool(r.URL.Query().Get("permanent")); permanent {
+        if err := fs.DeleteFile(fileNode.TrieNode.Path, userID); err != nil {
+            http.Error(w, err.Error(), http.StatusInternalServerError)
+            return
+        }
+        w.WriteHeader(http.StatusOK)
+        json.NewEncoder(w).Encode(map[string]string{"message": "File deleted successfully"})
+        return
+    }
+    
+    entry, err := fs.Trash(fileNode.TrieNode.Path, false, userID)
+    if err != nil {
         http.Error(w, err.Error(), http.StatusInternalServerError)
         return
     }
     
     w.WriteHeader(http.StatusOK)
-    json.NewEncoder(w).Encode(map[string]string{"message": "File deleted successfully"})
+    json.NewEncoder(w).Encode(map[string]interface{}{"message": "File moved to trash", "trash_entry": entry})
 }
 
 // Directory handlers
@@ -214,7 +396,7 @@ func (app *App) CreateDirectory(w http.ResponseWriter, r *http.Request) {
     
     json.NewDecoder(r.Body).Decode(&req)
     
-    fs := NewFileSystem(app.DB, userID)
+    fs := NewFileSystem(app.DB, app.Blobs, app.Keys, userID)
     trieNode, err := fs.Insert(req.Path, false, userID)
     if err != nil {
         http.Error(w, err.Error(), http.StatusBadRequest)
@@ -237,17 +419,65 @@ func (app *App) ListDirectory(w http.ResponseWriter, r *http.Request) {
         dirPath = "/"
     }
     
-    fs := NewFileSystem(app.DB, userID)
-    contents, err := fs.ListDirectory(dirPath, userID)
+    lstat := r.URL.Query().Get("lstat") == "true"
+    
+    opts, err := parseListOptions(r, userID, "name", false)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    
+    fs := NewFileSystem(app.DB, app.Blobs, app.Keys, userID)
+    contents, page, err := fs.ListDirectory(dirPath, userID, lstat, opts)
     if err != nil {
-        http.Error(w, err.Error(), http.StatusNotFound)
+        http.Error(w, err.Error(), resolveErrorStatus(err))
         return
     }
+    writePageHeaders(w, page)
     
     w.Header().Set("Content-Type", "application/json")
     json.NewEncoder(w).Encode(contents)
 }
 
+func (app *App) DeleteDirectory(w http.ResponseWriter, r *http.Request) {
+    userID := app.getUserID(r)
+    dirPath := r.URL.Query().Get("path")
+    recursive, _ := strconv.ParseBool(r.URL.Query().Get("recursive"))
+    
+    permanent, _ := strconv.ParseBool(r.URL.Query().Get("permanent"))
+    
+    fs := NewFileSystem(app.DB, app.Blobs, app.Keys, userID)
+    
+    var response map[string]interface{}
+    var err error
+    if permanent {
+        var filesRemoved int
+        filesRemoved, err = fs.DeleteDirectory(dirPath, recursive, userID)
+        response = map[string]interface{}{
+            "message":       "Directory deleted successfully",
+            "files_removed": filesRemoved,
+        }
+    } else {
+        var entry *TrashEntry
+        entry, err = fs.Trash(dirPath, recursive, userID)
+        response = map[string]interface{}{
+            "message":     "Directory moved to trash",
+            "trash_entry": entry,
+        }
+    }
+    if err == ErrDirectoryNotEmpty {
+        http.Error(w, "Directory not empty, use recursive=true", http.StatusConflict)
+        return
+    }
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(response)
+}
+
 // Sharing handlers
 func (app *App) CreateShare(w http.ResponseWriter, r *http.Request) {
     vars := mux.Vars(r)
@@ -287,7 +517,7 @@ func (app *App) GetSharedFile(w http.ResponseWriter, r *http.Request) {
     password := r.URL.Query().Get("password")
     
     var share Share
-    if err := app.DB.Where("token = ?", token).Preload("FileNode.DataBlock").First(&share).Error; err != nil {
+    if err := app.DB.Where("token = ?", token).Preload("FileNode.DataBlock").Preload("FileNode.TrieNode").First(&share).Error; err != nil || share.FileNode.TrieNode.Trashed {
         http.Error(w, "Share not found or expired", http.StatusNotFound)
         return
     }
@@ -311,13 +541,13 @@ func (app *App) GetSharedFile(w http.ResponseWriter, r *http.Request) {
     }
     
     // Increment share download counter
-    share.Downloads++
-    app.DB.Save(&share)
+    if isFullDownload(r, share.FileNode) {
+        share.Downloads++
+        app.DB.Save(&share)
+    }
     
     // Serve file
-    w.Header().Set("Content-Type", share.FileNode.ActualMimeType)
-    w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", share.FileNode.OriginalName))
-    w.Write(share.FileNode.DataBlock.Data)
+    app.serveFile(w, r, share.FileNode)
 }
 
 // Link handlers
@@ -330,7 +560,7 @@ func (app *App) CreateHardLink(w http.ResponseWriter, r *http.Request) {
     }
     json.NewDecoder(r.Body).Decode(&req)
     
-    fs := NewFileSystem(app.DB, userID)
+    fs := NewFileSystem(app.DB, app.Blobs, app.Keys, userID)
     if err := fs.CreateHardLink(req.SourcePath, req.DestPath, userID); err != nil {
         http.Error(w, err.Error(), http.StatusBadRequest)
         return
@@ -349,7 +579,7 @@ func (app *App) CreateSoftLink(w http.ResponseWriter, r *http.Request) {
     }
     json.NewDecoder(r.Body).Decode(&req)
     
-    fs := NewFileSystem(app.DB, userID)
+    fs := NewFileSystem(app.DB, app.Blobs, app.Keys, userID)
     if err := fs.CreateSoftLink(req.SourcePath, req.DestPath, userID); err != nil {
         http.Error(w, err.Error(), http.StatusBadRequest)
         return
@@ -359,6 +589,53 @@ func (app *App) CreateSoftLink(w http.ResponseWriter, r *http.Request) {
     json.NewEncoder(w).Encode(map[string]string{"message": "Soft link created"})
 }
 
+// MoveNode renames or moves a file, directory or link
+func (app *App) MoveNode(w http.ResponseWriter, r *http.Request) {
+    userID := app.getUserID(r)
+    
+    var req struct {
+        SourcePath string `json:"source_path"`
+        DestPath   string `json:"dest_path"`
+    }
+    json.NewDecoder(r.Body).Decode(&req)
+    
+    fs := NewFileSystem(app.DB, app.Blobs, app.Keys, userID)
+    node, err := fs.Move(req.SourcePath, req.DestPath, userID)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(node)
+}
+
+// CopyNode duplicates a file or directory tree without re-uploading its content
+func (app *App) CopyNode(w http.ResponseWriter, r *http.Request) {
+    userID := app.getUserID(r)
+    
+    var req struct {
+        SourcePath string `json:"source_path"`
+        DestPath   string `json:"dest_path"`
+    }
+    json.NewDecoder(r.Body).Decode(&req)
+    
+    fs := NewFileSystem(app.DB, app.Blobs, app.Keys, userID)
+    node, err := fs.Copy(req.SourcePath, req.DestPath, userID)
+    if err == ErrQuotaExceeded {
+        http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+        return
+    }
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(http.StatusCreated)
+    json.NewEncoder(w).Encode(node)
+}
+
 // Admin handlers
 func (app *App) GetAllUsers(w http.ResponseWriter, r *http.Request) {
     userID := app.getUserID(r)
@@ -414,7 +691,7 @@ func (app *App) GetStorageStats(w http.ResponseWriter, r *http.Request) {
         return
     }
     
-    fs := NewFileSystem(app.DB, userID)
+    fs := NewFileSystem(app.DB, app.Blobs, app.Keys, userID)
     stats := fs.GetDeduplicationStats()
     
     w.Header().Set("Content-Type", "application/json")
@@ -438,16 +715,6 @@ func (app *App) GetAuditLogs(w http.ResponseWriter, r *http.Request) {
 }
 
 // Helper methods
-func (app *App) generateJWT(userID uint) string {
-    token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-        "user_id": userID,
-        "exp":     time.Now().Add(time.Hour * 24 * 7).Unix(),
-    })
-    
-    tokenString, _ := token.SignedString([]byte(app.JWTSecret))
-    return tokenString
-}
-
 func (app *App) getUserID(r *http.Request) uint {
     userID := r.Context().Value("userID")
     if userID == nil {
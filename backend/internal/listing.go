@@ -0,0 +1,329 @@
+package internal
+
+import (
+    "encoding/base64"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "net/http"
+    "strconv"
+    "strings"
+    "time"
+
+    "gorm.io/gorm"
+)
+
+// Listings are keyset-paginated: the cursor carries the sort value and id of the last
+// row served, so pages stay stable while rows are added or removed
+const (
+    defaultPageSize = 100
+    maxPageSize     = 1000
+)
+
+// ListOptions - Sorting, filtering and pagination for GetFiles and ListDirectory
+type ListOptions struct {
+    Sort          string // "name", "size", "created_at" or "downloads"
+    Desc          bool
+    Limit         int
+    Cursor        *listCursor
+    MinSize       *int64
+    MaxSize       *int64
+    CreatedAfter  *time.Time
+    CreatedBefore *time.Time
+    Tags          []string // Every tag must be present
+    AnyTags       []string // At least one tag must be present
+    DedupedOnly   bool
+    OwnerID       *uint
+    Metadata      map[string]string // Metadata values (as text) that must match
+    MetadataKeys  []string          // Metadata keys that must be present
+}
+
+// Page - What a paginated listing reports besides its rows
+type Page struct {
+    Total      int64
+    NextCursor string
+}
+
+type listCursor struct {
+    Value string `json:"v"`
+    ID    uint   `json:"id"`
+}
+
+// listColumns maps the sortable and filterable fields onto a query's SQL expressions
+type listColumns struct {
+    ID        string
+    Name      string
+    Size      string
+    CreatedAt string
+    Downloads string
+    TrieNode  string
+    Deduped   string
+    Owner     string
+    Metadata  string
+}
+
+var fileListColumns = listColumns{
+    ID:        "file_nodes.id",
+    Name:      "file_nodes.original_name",
+    Size:      "file_nodes.size",
+    CreatedAt: "file_nodes.created_at",
+    Downloads: "file_nodes.downloads",
+    TrieNode:  "file_nodes.trie_node_id",
+    Deduped:   "file_nodes.is_deduped",
+    Owner:     "(SELECT owner_id FROM trie_nodes WHERE trie_nodes.id = file_nodes.trie_node_id)",
+    Metadata:  "file_nodes.metadata",
+}
+
+// Directory entries are trie nodes; files contribute size and downloads
+var dirListColumns = listColumns{
+    ID:        "trie_nodes.id",
+    Name:      "trie_nodes.name",
+    Size:      "COALESCE(file_nodes.size, 0)",
+    CreatedAt: "trie_nodes.created_at",
+    Downloads: "COALESCE(file_nodes.downloads, 0)",
+    TrieNode:  "trie_nodes.id",
+    Deduped:   "file_nodes.is_deduped",
+    Owner:     "trie_nodes.owner_id",
+    Metadata:  "file_nodes.metadata",
+}
+
+// parseListOptions reads sort, order, limit, cursor, min_size, max_size, created_after,
+// created_before, tags (all of), tags_any (one of), deduped, owner ("me" or a user id),
+// meta.<key>=<value> and meta_exists=<key>,... from the query string
+func parseListOptions(r *http.Request, userID uint, defaultSort string, defaultDesc bool) (ListOptions, error) {
+    q := r.URL.Query()
+    opts := ListOptions{Sort: defaultSort, Desc: defaultDesc, Limit: defaultPageSize}
+
+    if sort := q.Get("sort"); sort != "" {
+        switch sort {
+        case "name", "size", "created_at", "downloads":
+            opts.Sort = sort
+            opts.Desc = false
+        default:
+            return opts, errors.New("sort must be name, size, created_at or downloads")
+        }
+    }
+    switch q.Get("order") {
+    case "":
+    case "asc":
+        opts.Desc = false
+    case "desc":
+        opts.Desc = true
+    default:
+        return opts, errors.New("order must be asc or desc")
+    }
+
+    if value := q.Get("limit"); value != "" {
+        n, err := strconv.Atoi(value)
+        if err != nil || n < 1 {
+            return opts, errors.New("invalid limit")
+        }
+        if n > maxPageSize {
+            n = maxPageSize
+        }
+        opts.Limit = n
+    }
+    if value := q.Get("cursor"); value != "" {
+        raw, err := base64.RawURLEncoding.DecodeString(value)
+        if err != nil {
+            return opts, errors.New("invalid cursor")
+        }
+        opts.Cursor = &listCursor{}
+        if err := json.Unmarshal(raw, opts.Cursor); err != nil {
+            return opts, errors.New("invalid cursor")
+        }
+        // A cursor only resumes the sort it was issued for
+        if _, err := opts.cursorValue(); err != nil {
+            return opts, err
+        }
+    }
+
+    for name, dst := range map[string]**int64{"min_size": &opts.MinSize, "max_size": &opts.MaxSize} {
+        if value := q.Get(name); value != "" {
+            n, err := strconv.ParseInt(value, 10, 64)
+            if err != nil {
+                return opts, fmt.Errorf("invalid %s", name)
+            }
+            *dst = &n
+        }
+    }
+    for name, dst := range map[string]**time.Time{"created_after": &opts.CreatedAfter, "created_before": &opts.CreatedBefore} {
+        if value := q.Get(name); value != "" {
+            t, err := parseListTime(value)
+            if err != nil {
+                return opts, fmt.Errorf("invalid %s: use RFC 3339 or YYYY-MM-DD", name)
+            }
+            *dst = &t
+        }
+    }
+
+    for name, dst := range map[string]*[]string{"tags": &opts.Tags, "tags_any": &opts.AnyTags} {
+        if value := q.Get(name); value != "" {
+            for _, tag := range strings.Split(value, ",") {
+                if strings.TrimSpace(tag) == "" {
+                    continue
+                }
+                tag, err := normalizeTag(tag)
+                if err != nil {
+                    return opts, fmt.Errorf("invalid %s: %v", name, err)
+                }
+                *dst = append(*dst, tag)
+            }
+        }
+    }
+    opts.DedupedOnly = q.Get("deduped") == "true"
+
+    for name, values := range q {
+        if key := strings.TrimPrefix(name, "meta."); key != name && key != "" {
+            if opts.Metadata == nil {
+                opts.Metadata = make(map[string]string)
+            }
+            opts.Metadata[key] = values[0]
+        }
+    }
+    if value := q.Get("meta_exists"); value != "" {
+        for _, key := range strings.Split(value, ",") {
+            if key = strings.TrimSpace(key); key != "" {
+                opts.MetadataKeys = append(opts.MetadataKeys, key)
+            }
+        }
+    }
+
+    if value := q.Get("owner"); value != "" {
+        ownerID := userID
+        if value != "me" {
+            n, err := strconv.ParseUint(value, 10, 32)
+            if err != nil {
+                return opts, errors.New("owner must be a user id or \"me\"")
+            }
+            ownerID = uint(n)
+        }
+        opts.OwnerID = &ownerID
+    }
+
+    return opts, nil
+}
+
+func parseListTime(value string) (time.Time, error) {
+    if t, err := time.Parse(time.RFC3339, value); err == nil {
+        return t, nil
+    }
+    return time.Parse("2006-01-02", value)
+}
+
+// filter applies the option filters (not the cursor) to query
+func (o ListOptions) filter(query *gorm.DB, cols listColumns) *gorm.DB {
+    if o.MinSize != nil {
+        query = query.Where(cols.Size+" >= ?", *o.MinSize)
+    }
+    if o.MaxSize != nil {
+        query = query.Where(cols.Size+" <= ?", *o.MaxSize)
+    }
+    if o.CreatedAfter != nil {
+        query = query.Where(cols.CreatedAt+" >= ?", *o.CreatedAfter)
+    }
+    if o.CreatedBefore != nil {
+        query = query.Where(cols.CreatedAt+" < ?", *o.CreatedBefore)
+    }
+    tagged := "EXISTS (SELECT 1 FROM node_tags JOIN tags ON tags.id = node_tags.tag_id WHERE node_tags.trie_node_id = " + cols.TrieNode
+    for _, tag := range o.Tags {
+        query = query.Where(tagged+" AND tags.name = ?)", tag)
+    }
+    if len(o.AnyTags) > 0 {
+        query = query.Where(tagged+" AND tags.name IN ?)", o.AnyTags)
+    }
+    if o.DedupedOnly {
+        query = query.Where(cols.Deduped+" = ?", true)
+    }
+    if o.OwnerID != nil {
+        query = query.Where(cols.Owner+" = ?", *o.OwnerID)
+    }
+    // ->> renders numbers and booleans as text, so ?meta.build=42 matches 42 and "42"
+    for key, value := range o.Metadata {
+        query = query.Where(cols.Metadata+" ->> ? = ?", key, value)
+    }
+    for _, key := range o.MetadataKeys {
+        query = query.Where(cols.Metadata+" -> ? IS NOT NULL", key)
+    }
+    return query
+}
+
+// page orders query and resumes it after the cursor; it fetches one extra row so
+// the caller can tell whether another page follows
+func (o ListOptions) page(query *gorm.DB, cols listColumns) (*gorm.DB, error) {
+    sortCol := o.sortColumn(cols)
+    direction, cmp := "ASC", ">"
+    if o.Desc {
+        direction, cmp = "DESC", "<"
+    }
+
+    if o.Cursor != nil {
+        value, err := o.cursorValue()
+        if err != nil {
+            return nil, err
+        }
+        query = query.Where(fmt.Sprintf("(%s %s ? OR (%s = ? AND %s %s ?))", sortCol, cmp, sortCol, cols.ID, cmp),
+            value, value, o.Cursor.ID)
+    }
+
+    return query.Order(fmt.Sprintf("%s %s, %s %s", sortCol, direction, cols.ID, direction)).Limit(o.Limit + 1), nil
+}
+
+func (o ListOptions) sortColumn(cols listColumns) string {
+    switch o.Sort {
+    case "name":
+        return cols.Name
+    case "size":
+        return cols.Size
+    case "downloads":
+        return cols.Downloads
+    default:
+        return cols.CreatedAt
+    }
+}
+
+// cursorValue decodes the cursor's sort value into the sort column's type
+func (o ListOptions) cursorValue() (interface{}, error) {
+    switch o.Sort {
+    case "name":
+        return o.Cursor.Value, nil
+    case "created_at":
+        t, err := time.Parse(time.RFC3339Nano, o.Cursor.Value)
+        if err != nil {
+            return nil, errors.New("invalid cursor")
+        }
+        return t, nil
+    default:
+        n, err := strconv.ParseInt(o.Cursor.Value, 10, 64)
+        if err != nil {
+            return nil, errors.New("invalid cursor")
+        }
+        return n, nil
+    }
+}
+
+// encodeCursor builds the cursor that resumes after a row with these sort fields
+func (o ListOptions) encodeCursor(id uint, name string, size int64, createdAt time.Time, downloads int) string {
+    cursor := listCursor{ID: id}
+    switch o.Sort {
+    case "name":
+        cursor.Value = name
+    case "size":
+        cursor.Value = strconv.FormatInt(size, 10)
+    case "downloads":
+        cursor.Value = strconv.Itoa(downloads)
+    default:
+        cursor.Value = createdAt.UTC().Format(time.RFC3339Nano)
+    }
+
+    raw, _ := json.Marshal(cursor)
+    return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+// writePageHeaders reports the total row count and the next page's cursor
+func writePageHeaders(w http.ResponseWriter, page Page) {
+    w.Header().Set("X-Total-Count", strconv.FormatInt(page.Total, 10))
+    if page.NextCursor != "" {
+        w.Header().Set("X-Next-Cursor", page.NextCursor)
+    }
+}
@@ -0,0 +1,121 @@
+package internal
+
+import (
+    "bytes"
+    "fmt"
+    "mime"
+    "net"
+    "net/smtp"
+    "os"
+    "path/filepath"
+    "strings"
+    "time"
+
+    "file-vault/pkg"
+)
+
+// Message - A plain-text email
+type Message struct {
+    To      string
+    Subject string
+    Body    string
+}
+
+// Mailer - Delivers account emails (password resets, address verification)
+type Mailer interface {
+    Send(msg Message) error
+}
+
+// NewMailerFromEnv picks the configured mailer (the local outbox by default)
+func NewMailerFromEnv() (Mailer, error) {
+    from := os.Getenv("MAIL_FROM")
+    if from == "" {
+        from = "File Vault <no-reply@filevault.local>"
+    }
+
+    switch backend := os.Getenv("MAILER"); backend {
+    case "", "outbox":
+        dir := os.Getenv("MAIL_OUTBOX_DIR")
+        if dir == "" {
+            dir = filepath.Join("uploads", "outbox")
+        }
+        return NewOutboxMailer(dir, from)
+    case "smtp":
+        host := os.Getenv("SMTP_HOST")
+        if host == "" {
+            return nil, fmt.Errorf("SMTP_HOST is required for the smtp mailer")
+        }
+        port := os.Getenv("SMTP_PORT")
+        if port == "" {
+            port = "587"
+        }
+        return &SMTPMailer{
+            Addr:     net.JoinHostPort(host, port),
+            Username: os.Getenv("SMTP_USERNAME"),
+            Password: os.Getenv("SMTP_PASSWORD"),
+            From:     from,
+        }, nil
+    default:
+        return nil, fmt.Errorf("unknown mailer: %s", backend)
+    }
+}
+
+// SMTPMailer sends through an SMTP relay; net/smtp upgrades to STARTTLS when offered
+type SMTPMailer struct {
+    Addr     string
+    Username string // Empty for relays without authentication
+    Password string
+    From     string
+}
+
+func (m *SMTPMailer) Send(msg Message) error {
+    var auth smtp.Auth
+    if m.Username != "" {
+        host, _, _ := net.SplitHostPort(m.Addr)
+        auth = smtp.PlainAuth("", m.Username, m.Password, host)
+    }
+    return smtp.SendMail(m.Addr, auth, envelopeAddress(m.From), []string{msg.To}, formatMessage(m.From, msg))
+}
+
+// OutboxMailer writes each message to an .eml file instead of sending it, for local
+// development and tests
+type OutboxMailer struct {
+    Dir  string
+    From string
+}
+
+func NewOutboxMailer(dir, from string) (*OutboxMailer, error) {
+    if err := os.MkdirAll(dir, 0o755); err != nil {
+        return nil, err
+    }
+    return &OutboxMailer{Dir: dir, From: from}, nil
+}
+
+func (m *OutboxMailer) Send(msg Message) error {
+    name := fmt.Sprintf("%s-%s.eml", time.Now().UTC().Format("20060102T150405"), utils.GenerateToken()[:8])
+    return os.WriteFile(filepath.Join(m.Dir, name), formatMessage(m.From, msg), 0o600)
+}
+
+var headerSafe = strings.NewReplacer("\r", "", "\n", "")
+
+// formatMessage renders an RFC 5322 message with a UTF-8 plain-text body
+func formatMessage(from string, msg Message) []byte {
+    var buf bytes.Buffer
+    // Header values never carry line breaks, so user input can't add headers
+    fmt.Fprintf(&buf, "From: %s\r\n", headerSafe.Replace(from))
+    fmt.Fprintf(&buf, "To: %s\r\n", headerSafe.Replace(msg.To))
+    fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", headerSafe.Replace(msg.Subject)))
+    fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+    buf.WriteString("MIME-Version: 1.0\r\n")
+    buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+    buf.WriteString(strings.ReplaceAll(msg.Body, "\n", "\r\n"))
+    return buf.Bytes()
+}
+
+// envelopeAddress extracts the bare address from "Name <address>"
+func envelopeAddress(from string) string {
+    if start, end := strings.LastIndex(from, "<"), strings.LastIndex(from, ">"); start >= 0 && end > start {
+        return from[start+1 : end]
+    }
+    return from
+}
@@ -0,0 +1,137 @@
+package internal
+
+import (
+    "database/sql/driver"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "net/http"
+
+    "gorm.io/gorm"
+    "gorm.io/gorm/clause"
+)
+
+// Custom metadata is a JSON object stored as jsonb on the FileNode, so listings can
+// filter on it in SQL. Values may be any JSON; filters compare their text form.
+const (
+    maxMetadataSize   = 16 << 10
+    maxMetadataKeyLen = 128
+)
+
+var ErrInvalidMetadata = fmt.Errorf("metadata must be a JSON object of at most %d bytes with keys of 1-%d characters", maxMetadataSize, maxMetadataKeyLen)
+
+// Metadata - User-defined key/value data attached to a file
+type Metadata map[string]interface{}
+
+// Value stores Metadata as JSON; nil is stored as an empty object
+func (m Metadata) Value() (driver.Value, error) {
+    if m == nil {
+        return "{}", nil
+    }
+    data, err := json.Marshal(m)
+    return string(data), err
+}
+
+func (m *Metadata) Scan(value interface{}) error {
+    var data []byte
+    switch v := value.(type) {
+    case nil:
+        *m = nil
+        return nil
+    case []byte:
+        data = v
+    case string:
+        data = []byte(v)
+    default:
+        return errors.New("unsupported metadata column type")
+    }
+    return json.Unmarshal(data, m)
+}
+
+// parseMetadata decodes and validates a JSON metadata object
+func parseMetadata(data []byte) (Metadata, error) {
+    var m Metadata
+    if err := json.Unmarshal(data, &m); err != nil || m == nil {
+        return nil, ErrInvalidMetadata
+    }
+    return m, m.validate()
+}
+
+func (m Metadata) validate() error {
+    for key := range m {
+        if key == "" || len(key) > maxMetadataKeyLen {
+            return ErrInvalidMetadata
+        }
+    }
+    data, err := json.Marshal(m)
+    if err != nil || len(data) > maxMetadataSize {
+        return ErrInvalidMetadata
+    }
+    return nil
+}
+
+// merge applies patch as a JSON merge patch (RFC 7386) at the top level: null
+// values remove keys, anything else replaces them
+func (m Metadata) merge(patch Metadata) Metadata {
+    merged := make(Metadata, len(m)+len(patch))
+    for key, value := range m {
+        merged[key] = value
+    }
+    for key, value := range patch {
+        if value == nil {
+            delete(merged, key)
+        } else {
+            merged[key] = value
+        }
+    }
+    return merged
+}
+
+// UpdateMetadata - Merges patch into a file's metadata
+func (fs *FileSystem) UpdateMetadata(fileNode *FileNode, patch Metadata) error {
+    return fs.DB.Transaction(func(tx *gorm.DB) error {
+        // Re-read under a row lock so concurrent patches don't drop each other's keys
+        var current FileNode
+        if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Select("id", "metadata").First(&current, fileNode.ID).Error; err != nil {
+            return err
+        }
+
+        merged := current.Metadata.merge(patch)
+        if err := merged.validate(); err != nil {
+            return err
+        }
+        fileNode.Metadata = merged
+        return tx.Model(&FileNode{}).Where("id = ?", fileNode.ID).Update("metadata", merged).Error
+    })
+}
+
+// Metadata handlers
+
+// UpdateFileMetadata handles PATCH /api/files/{id}/metadata with a JSON merge patch:
+// {"build_id": "123", "stale_key": null}
+func (app *App) UpdateFileMetadata(w http.ResponseWriter, r *http.Request) {
+    fileNode, ok := app.ownedFile(w, r)
+    if !ok {
+        return
+    }
+
+    var patch Metadata
+    if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxMetadataSize)).Decode(&patch); err != nil || patch == nil {
+        http.Error(w, ErrInvalidMetadata.Error(), http.StatusBadRequest)
+        return
+    }
+
+    fs := NewFileSystem(app.DB, app.Blobs, app.Keys, fileNode.TrieNode.OwnerID)
+    err := fs.UpdateMetadata(fileNode, patch)
+    if err == ErrInvalidMetadata {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(fileNode)
+}
@@ -4,10 +4,8 @@ import (
     "context"
     "fmt"
     "net/http"
-    "strings"
     "sync"
     
-    "github.com/golang-jwt/jwt/v5"
     "golang.org/x/time/rate"
 )
 
@@ -17,30 +15,36 @@ var rateLimiterMutex sync.RWMutex
 // Fix middleware to match mux.MiddlewareFunc signature
 func (app *App) AuthMiddleware(next http.Handler) http.Handler {
     return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-        authHeader := r.Header.Get("Authorization")
-        if authHeader == "" {
+        token := bearerToken(r)
+        if apiKey := r.Header.Get("X-API-Key"); apiKey != "" {
+            token = apiKey
+        }
+        if token == "" {
             http.Error(w, "Missing authorization header", http.StatusUnauthorized)
             return
         }
         
-        tokenString := strings.Replace(authHeader, "Bearer ", "", 1)
-        
-        token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-            return []byte(app.JWTSecret), nil
-        })
+        // API keys stand in for a session, restricted to their scopes
+        if isAPIKey(token) {
+            key, ok := app.authenticateAPIKey(token)
+            if !ok {
+                http.Error(w, "Invalid API key", http.StatusUnauthorized)
+                return
+            }
+            next.ServeHTTP(w, withAPIKey(r, key))
+            return
+        }
         
-        if err != nil || !token.Valid {
+        userID, jti, err := app.parseAccessToken(token)
+        if err != nil {
             http.Error(w, "Invalid token", http.StatusUnauthorized)
             return
         }
-        
-        claims, ok := token.Claims.(jwt.MapClaims)
-        if !ok {
-            http.Error(w, "Invalid token claims", http.StatusUnauthorized)
+        if app.isTokenRevoked(jti) {
+            http.Error(w, "Token has been revoked", http.StatusUnauthorized)
             return
         }
         
-        userID := uint(claims["user_id"].(float64))
         ctx := context.WithValue(r.Context(), "userID", userID)
         
         next.ServeHTTP(w, r.WithContext(ctx))
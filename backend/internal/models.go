@@ -1,6 +1,7 @@
 package internal
 
 import (
+    "strings"
     "time"
 )
 
@@ -14,18 +15,48 @@ type User struct {
     QuotaMax        int64     `gorm:"default:10485760" json:"quota_max"`
     StorageSaved    int64     `gorm:"default:0" json:"storage_saved"`
     RateLimitCalls  int       `gorm:"default:2" json:"rate_limit_calls"`
+    TOTPEnabled     bool      `gorm:"default:false" json:"totp_enabled"`
+    TOTPSecret      string    `json:"-"` // Base32; set at enrollment, before 2FA is enabled
+    TOTPLastStep    int64     `gorm:"default:0" json:"-"` // Last accepted time step, against code replay
+    TOTPFailures    int       `gorm:"default:0" json:"-"` // Wrong codes in a row
+    TOTPLockedUntil *time.Time `json:"-"`
+    EmailVerified   bool      `gorm:"default:false" json:"email_verified"`
     CreatedAt       time.Time `json:"created_at"`
 }
 
 type DataBlock struct {
     ID       uint   `gorm:"primaryKey" json:"id"`
-    Hash     string `gorm:"unique;not null;index" json:"hash"`
-    Data     []byte `json:"-"`
+    Hash     string `gorm:"unique;not null;index" json:"hash"` // Blob key in the BlobStore
     Size     int64  `gorm:"not null" json:"size"`
     RefCount int    `gorm:"default:1" json:"ref_count"`
+    Chunked  bool   `gorm:"default:false" json:"chunked"` // Content lives in BlockChunks, not one blob
     CreatedAt time.Time `json:"created_at"`
 }
 
+// Chunk - A content-defined piece of a DataBlock, shared across blocks
+type Chunk struct {
+    ID         uint      `gorm:"primaryKey" json:"id"`
+    Hash       string    `gorm:"unique;not null;index" json:"hash"` // Blob key in the BlobStore
+    Size       int64     `gorm:"not null" json:"size"`
+    RefCount   int       `gorm:"default:1" json:"ref_count"`
+    Codec      string    `gorm:"default:none" json:"codec"` // "none", "gzip" or "zstd"
+    StoredSize int64     `gorm:"not null;default:0" json:"stored_size"`
+    WrappedKey []byte    `json:"-"` // Data key sealed by the master key; empty when stored in plaintext
+    KeyID      string    `gorm:"index" json:"key_id,omitempty"` // Fingerprint of the wrapping master key
+    CreatedAt  time.Time `json:"created_at"`
+}
+
+// BlockChunk - One entry of a DataBlock's ordered chunk manifest
+type BlockChunk struct {
+    ID          uint  `gorm:"primaryKey" json:"id"`
+    DataBlockID uint  `gorm:"not null;index" json:"data_block_id"`
+    Seq         int   `gorm:"not null" json:"seq"`
+    ChunkID     uint  `gorm:"not null;index" json:"chunk_id"`
+    Chunk       Chunk `json:"chunk"`
+    Offset      int64 `gorm:"not null" json:"offset"`
+    Size        int64 `gorm:"not null" json:"size"`
+}
+
 type TrieNode struct {
     ID       uint       `gorm:"primaryKey" json:"id"`
     Name     string     `gorm:"not null" json:"name"`
@@ -36,6 +67,7 @@ type TrieNode struct {
     Owner    User       `json:"owner"`
     NodeType string     `gorm:"not null" json:"node_type"` // "file", "directory", "symlink"
     IsPublic bool       `gorm:"default:false" json:"is_public"`
+    Trashed  bool       `gorm:"default:false;index" json:"trashed"`
     CreatedAt time.Time `json:"created_at"`
 }
 
@@ -52,11 +84,53 @@ type FileNode struct {
     DataBlock     DataBlock `json:"data_block"`
     RefCount      int       `gorm:"default:1" json:"ref_count"`
     Downloads     int       `gorm:"default:0" json:"downloads"`
-    Tags          string    `json:"tags"`
+    Tags          string    `json:"tags"` // Comma-separated tag names, kept in sync with NodeTags
+    Metadata      Metadata  `gorm:"type:jsonb;not null;default:'{}'" json:"metadata"`
     IsDeduped     bool      `gorm:"default:false" json:"is_deduped"`
+    Version       int       `gorm:"default:1" json:"version"`
+    ModifiedAt    time.Time `json:"modified_at"` // When the current version's content was uploaded
     CreatedAt     time.Time `json:"created_at"`
 }
 
+// FileVersion - A superseded version of a FileNode; keeps its DataBlock referenced
+type FileVersion struct {
+    ID             uint      `gorm:"primaryKey" json:"id"`
+    FileNodeID     uint      `gorm:"not null;uniqueIndex:idx_file_version" json:"file_node_id"`
+    Version        int       `gorm:"not null;uniqueIndex:idx_file_version" json:"version"`
+    Hash           string    `gorm:"not null" json:"hash"`
+    Size           int64     `gorm:"not null" json:"size"`
+    MimeType       string    `gorm:"not null" json:"mime_type"`
+    ActualMimeType string    `gorm:"not null" json:"actual_mime_type"`
+    DataBlockID    uint      `gorm:"not null" json:"data_block_id"`
+    DataBlock      DataBlock `json:"-"`
+    IsDeduped      bool      `gorm:"default:false" json:"is_deduped"`
+    CreatedAt      time.Time `json:"created_at"` // When this version was uploaded
+}
+
+// DocumentText - Text extracted from a data block at upload, indexed for full-text search
+type DocumentText struct {
+    ID           uint      `gorm:"primaryKey" json:"id"`
+    DataBlockID  uint      `gorm:"not null;uniqueIndex" json:"data_block_id"`
+    Content      string    `gorm:"type:text;not null" json:"-"`
+    SearchVector string    `gorm:"type:tsvector" json:"-"`
+    CreatedAt    time.Time `json:"created_at"`
+}
+
+// Tag - A user's label for files and directories; names are unique per owner
+type Tag struct {
+    ID        uint      `gorm:"primaryKey" json:"id"`
+    OwnerID   uint      `gorm:"not null;uniqueIndex:idx_tag_owner_name" json:"owner_id"`
+    Name      string    `gorm:"not null;uniqueIndex:idx_tag_owner_name" json:"name"`
+    CreatedAt time.Time `json:"created_at"`
+}
+
+// NodeTag - Links a Tag to a file, directory or symlink
+type NodeTag struct {
+    TrieNodeID uint      `gorm:"primaryKey" json:"trie_node_id"`
+    TagID      uint      `gorm:"primaryKey;index" json:"tag_id"`
+    CreatedAt  time.Time `json:"created_at"`
+}
+
 type DirNode struct {
     ID         uint      `gorm:"primaryKey" json:"id"`
     TrieNodeID uint      `gorm:"not null" json:"trie_node_id"`
@@ -93,3 +167,130 @@ type AuditLog struct {
     IPAddress  string    `json:"ip_address"`
     CreatedAt  time.Time `json:"created_at"`
 }
+
+// RefreshToken - One link in a login session's chain of rotating refresh tokens; only
+// the token's hash is stored
+type RefreshToken struct {
+    ID        uint       `gorm:"primaryKey" json:"id"`
+    UserID    uint       `gorm:"not null;index" json:"user_id"`
+    FamilyID  string     `gorm:"not null;index" json:"family_id"` // Shared by every rotation of one login
+    TokenHash string     `gorm:"unique;not null" json:"-"`
+    AccessJTI string     `gorm:"not null" json:"-"` // The access token issued alongside
+    ExpiresAt time.Time  `gorm:"not null;index" json:"expires_at"`
+    RevokedAt *time.Time `json:"revoked_at,omitempty"`
+    UserAgent string     `json:"user_agent"`
+    IPAddress string     `json:"ip_address"`
+    CreatedAt time.Time  `json:"created_at"`
+}
+
+// RevokedToken - A denylisted access token, kept until the token would have expired
+type RevokedToken struct {
+    JTI       string    `gorm:"primaryKey" json:"jti"`
+    UserID    uint      `gorm:"not null;index" json:"user_id"`
+    ExpiresAt time.Time `gorm:"not null;index" json:"expires_at"`
+    CreatedAt time.Time `json:"created_at"`
+}
+
+// APIKey - A user-managed bearer key limited to a set of scopes; only its hash is stored
+type APIKey struct {
+    ID         uint       `gorm:"primaryKey" json:"id"`
+    UserID     uint       `gorm:"not null;index" json:"user_id"`
+    Name       string     `gorm:"not null" json:"name"`
+    Prefix     string     `gorm:"not null" json:"prefix"` // Leading characters of the key, to tell keys apart
+    KeyHash    string     `gorm:"unique;not null" json:"-"`
+    Scopes     string     `gorm:"not null" json:"scopes"` // Comma-separated, e.g. "files:read,files:write"
+    LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+    ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+    RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+    CreatedAt  time.Time  `json:"created_at"`
+}
+
+// ScopeList splits Scopes; a key always has at least one scope, so this is never nil
+func (k APIKey) ScopeList() []string {
+    return strings.Split(k.Scopes, ",")
+}
+
+// RecoveryCode - A single-use 2FA backup code; only its hash is stored
+type RecoveryCode struct {
+    ID        uint       `gorm:"primaryKey" json:"id"`
+    UserID    uint       `gorm:"not null;index" json:"user_id"`
+    CodeHash  string     `gorm:"not null" json:"-"`
+    UsedAt    *time.Time `json:"used_at,omitempty"`
+    CreatedAt time.Time  `json:"created_at"`
+}
+
+// AccountToken - Records a password reset or email verification link so it works once
+type AccountToken struct {
+    JTI       string     `gorm:"primaryKey" json:"-"`
+    UserID    uint       `gorm:"not null;index" json:"user_id"`
+    Purpose   string     `gorm:"not null" json:"purpose"`
+    ExpiresAt time.Time  `gorm:"not null;index" json:"expires_at"`
+    UsedAt    *time.Time `json:"used_at,omitempty"`
+    CreatedAt time.Time  `json:"created_at"`
+}
+
+// Setting - A server-wide option changed at runtime by admins
+type Setting struct {
+    Key       string    `gorm:"primaryKey" json:"key"`
+    Value     string    `gorm:"not null" json:"value"`
+    UpdatedAt time.Time `json:"updated_at"`
+}
+
+// UploadSession tracks a resumable (tus) upload until it is assembled into a FileNode
+type UploadSession struct {
+    ID         string    `gorm:"primaryKey" json:"id"`
+    OwnerID    uint      `gorm:"not null;index" json:"owner_id"`
+    Filename   string    `gorm:"not null" json:"filename"`
+    MimeType   string    `json:"mime_type"`
+    Directory  string    `gorm:"not null" json:"directory"`
+    Versioning bool      `gorm:"default:false" json:"versioning"`
+    Metadata   Metadata  `gorm:"type:jsonb" json:"metadata,omitempty"`
+    Length     int64     `gorm:"not null" json:"length"`
+    Offset     int64     `gorm:"default:0" json:"offset"`
+    ExpiresAt  time.Time `json:"expires_at"`
+    CreatedAt  time.Time `json:"created_at"`
+}
+
+// TrashEntry - A deleted subtree kept restorable until the retention period ends
+type TrashEntry struct {
+    ID           uint      `gorm:"primaryKey" json:"id"`
+    OwnerID      uint      `gorm:"not null;index" json:"owner_id"`
+    TrieNodeID   uint      `gorm:"not null" json:"trie_node_id"`
+    TrieNode     TrieNode  `json:"trie_node"`
+    OriginalPath string    `gorm:"not null" json:"original_path"`
+    NodeType     string    `gorm:"not null" json:"node_type"`
+    Size         int64     `gorm:"default:0" json:"size"`
+    TrashedAt    time.Time `gorm:"not null;index" json:"trashed_at"`
+    PurgeAt      time.Time `gorm:"-" json:"purge_at"`
+}
+
+// Snapshot - A read-only point-in-time copy of a directory subtree
+type Snapshot struct {
+    ID        uint      `gorm:"primaryKey" json:"id"`
+    OwnerID   uint      `gorm:"not null;index" json:"owner_id"`
+    Name      string    `json:"name"`
+    RootPath  string    `gorm:"not null" json:"root_path"`
+    FileCount int       `gorm:"default:0" json:"file_count"`
+    TotalSize int64     `gorm:"default:0" json:"total_size"`
+    CreatedAt time.Time `json:"created_at"`
+}
+
+// SnapshotEntry - A node captured by a snapshot; file entries keep their DataBlock referenced
+type SnapshotEntry struct {
+    ID             uint      `gorm:"primaryKey" json:"id"`
+    SnapshotID     uint      `gorm:"not null;index:idx_snapshot_entry_parent" json:"snapshot_id"`
+    Path           string    `gorm:"not null" json:"path"` // Relative to the snapshot root, e.g. "/docs/a.txt"
+    ParentPath     string    `gorm:"not null;index:idx_snapshot_entry_parent" json:"parent_path"`
+    Name           string    `gorm:"not null" json:"name"`
+    NodeType       string    `gorm:"not null" json:"node_type"`
+    IsPublic       bool      `gorm:"default:false" json:"is_public"`
+    TargetPath     string    `json:"target_path,omitempty"` // Symlinks only
+    Hash           string    `json:"hash,omitempty"`
+    Size           int64     `gorm:"default:0" json:"size"`
+    MimeType       string    `json:"mime_type,omitempty"`
+    ActualMimeType string    `json:"actual_mime_type,omitempty"`
+    DataBlockID    *uint     `json:"data_block_id,omitempty"`
+    Tags           string    `json:"tags,omitempty"`
+    Metadata       Metadata  `gorm:"type:jsonb" json:"metadata,omitempty"`
+    ModifiedAt     time.Time `json:"modified_at"`
+}
@@ -0,0 +1,129 @@
+package internal
+
+import (
+    "context"
+    "io"
+    "os"
+    "strconv"
+
+    "github.com/minio/minio-go/v7"
+    "github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// Upper bound on memory buffered per multipart part when the size is unknown
+const s3PartSize = 16 << 20
+
+// S3BlobStore keeps blobs in an S3-compatible bucket (AWS S3, MinIO, ...)
+type S3BlobStore struct {
+    Client *minio.Client
+    Bucket string
+    Prefix string
+}
+
+// NewS3BlobStoreFromEnv reads S3_* settings and makes sure the bucket exists
+func NewS3BlobStoreFromEnv() (*S3BlobStore, error) {
+    endpoint := os.Getenv("S3_ENDPOINT")
+    if endpoint == "" {
+        endpoint = "s3.amazonaws.com"
+    }
+    bucket := os.Getenv("S3_BUCKET")
+    if bucket == "" {
+        bucket = "filevault"
+    }
+    useSSL := true
+    if v := os.Getenv("S3_USE_SSL"); v != "" {
+        useSSL, _ = strconv.ParseBool(v)
+    }
+
+    client, err := minio.New(endpoint, &minio.Options{
+        Creds:  credentials.NewStaticV4(os.Getenv("S3_ACCESS_KEY"), os.Getenv("S3_SECRET_KEY"), ""),
+        Secure: useSSL,
+        Region: os.Getenv("S3_REGION"),
+    })
+    if err != nil {
+        return nil, err
+    }
+
+    store := &S3BlobStore{
+        Client: client,
+        Bucket: bucket,
+        Prefix: os.Getenv("S3_PREFIX"),
+    }
+
+    ctx := context.Background()
+    exists, err := client.BucketExists(ctx, bucket)
+    if err != nil {
+        return nil, err
+    }
+    if !exists {
+        if err := client.MakeBucket(ctx, bucket, minio.MakeBucketOptions{Region: os.Getenv("S3_REGION")}); err != nil {
+            return nil, err
+        }
+    }
+
+    return store, nil
+}
+
+func (s *S3BlobStore) key(hash string) string {
+    return s.Prefix + hash
+}
+
+func (s *S3BlobStore) Put(hash string, r io.Reader) (int64, error) {
+    // Content-addressed: an existing object already holds these bytes
+    if size, err := s.Stat(hash); err == nil {
+        return size, nil
+    }
+    return s.Replace(hash, r)
+}
+
+// Replace uploads the object even if one exists; a PUT replaces it atomically
+func (s *S3BlobStore) Replace(hash string, r io.Reader) (int64, error) {
+    info, err := s.Client.PutObject(context.Background(), s.Bucket, s.key(hash), r, -1, minio.PutObjectOptions{
+        ContentType: "application/octet-stream",
+        PartSize:    s3PartSize,
+    })
+    if err != nil {
+        return 0, err
+    }
+    return info.Size, nil
+}
+
+func (s *S3BlobStore) Get(hash string) (io.ReadCloser, error) {
+    obj, err := s.Client.GetObject(context.Background(), s.Bucket, s.key(hash), minio.GetObjectOptions{})
+    if err != nil {
+        return nil, s.mapError(err)
+    }
+
+    // GetObject is lazy; Stat surfaces a missing key before the caller writes headers
+    if _, err := obj.Stat(); err != nil {
+        obj.Close()
+        return nil, s.mapError(err)
+    }
+    return obj, nil
+}
+
+func (s *S3BlobStore) Delete(hash string) error {
+    err := s.Client.RemoveObject(context.Background(), s.Bucket, s.key(hash), minio.RemoveObjectOptions{})
+    if err := s.mapError(err); err != nil && err != ErrBlobNotFound {
+        return err
+    }
+    return nil
+}
+
+func (s *S3BlobStore) Stat(hash string) (int64, error) {
+    info, err := s.Client.StatObject(context.Background(), s.Bucket, s.key(hash), minio.StatObjectOptions{})
+    if err != nil {
+        return 0, s.mapError(err)
+    }
+    return info.Size, nil
+}
+
+func (s *S3BlobStore) mapError(err error) error {
+    if err == nil {
+        return nil
+    }
+    if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+        return ErrBlobNotFound
+    }
+    return err
+}
@@ -0,0 +1,256 @@
+package internal
+
+import (
+    "archive/zip"
+    "bytes"
+    "encoding/json"
+    "encoding/xml"
+    "io"
+    "log"
+    "mime"
+    "net/http"
+    "path"
+    "regexp"
+    "sort"
+    "strconv"
+    "strings"
+)
+
+// Full-text search: text extracted at upload is stored per DataBlock, so dedup hits
+// share one index row, and matched with a Postgres tsvector
+const (
+    maxIndexedText   = 512 << 10 // tsvector values are capped at 1MB
+    maxDocumentSize  = 64 << 20  // Office documents larger than this aren't opened
+    searchConfig     = "english"
+    defaultSearchMax = 20
+    maxSearchResults = 100
+)
+
+// Formats that are plain text even though their MIME type isn't text/*
+var textMimeTypes = map[string]bool{
+    "application/json":       true,
+    "application/xml":        true,
+    "application/javascript": true,
+    "application/x-yaml":     true,
+    "application/yaml":       true,
+    "application/x-sh":       true,
+    "application/sql":        true,
+}
+
+var textExtensions = map[string]bool{
+    ".txt": true, ".md": true, ".csv": true, ".tsv": true, ".json": true, ".xml": true,
+    ".yaml": true, ".yml": true, ".log": true, ".html": true, ".htm": true, ".ini": true,
+    ".toml": true, ".go": true, ".py": true, ".js": true, ".ts": true, ".java": true,
+    ".c": true, ".h": true, ".cpp": true, ".rs": true, ".sql": true, ".sh": true,
+}
+
+// Zipped XML documents and the parts holding their text
+var documentParts = map[string][]string{
+    ".docx": {"word/document.xml"},
+    ".xlsx": {"xl/sharedStrings.xml"},
+    ".pptx": {"ppt/slides/slide*.xml"},
+    ".odt":  {"content.xml"},
+    ".ods":  {"content.xml"},
+    ".odp":  {"content.xml"},
+}
+
+var htmlTags = regexp.MustCompile(`(?s)<[^>]*>`)
+
+// SearchResult - A file whose content matches a search, best matches first
+type SearchResult struct {
+    FileNode
+    Rank    float64 `json:"rank"`
+    Snippet string  `json:"snippet"`
+}
+
+// indexDocument extracts searchable text from a new block's staged content.
+// Failures only cost searchability, so they are logged rather than returned.
+//
+// With encryption at rest only the tsvector is kept: the text itself would put file
+// contents back into the database in the clear, at the cost of result snippets. The
+// vector still holds the document's word stems, so it is not a confidential store.
+func (fs *FileSystem) indexDocument(block *DataBlock, staged *stagedUpload, filename, declaredMime string) {
+    text, ok := extractText(staged.File, staged.Size, filename, staged.MimeType, declaredMime)
+    if !ok || strings.TrimSpace(text) == "" {
+        return
+    }
+
+    content := text
+    if fs.Keys != nil {
+        content = ""
+    }
+    err := fs.DB.Exec(`INSERT INTO document_texts (data_block_id, content, search_vector, created_at)
+        VALUES (?, ?, to_tsvector(?, ?), NOW()) ON CONFLICT (data_block_id) DO NOTHING`,
+        block.ID, content, searchConfig, text).Error
+    if err != nil {
+        log.Printf("Failed to index %s: %v", filename, err)
+    }
+}
+
+// extractText returns the indexable text of a file, or false for formats it can't read
+func extractText(content io.ReaderAt, size int64, filename string, mimeTypes ...string) (string, bool) {
+    ext := strings.ToLower(path.Ext(filename))
+
+    if parts, ok := documentParts[ext]; ok {
+        if size > maxDocumentSize {
+            return "", false
+        }
+        return extractDocumentText(content, size, parts)
+    }
+
+    isHTML := ext == ".html" || ext == ".htm"
+    isText := textExtensions[ext]
+    for _, mimeType := range mimeTypes {
+        mediaType, _, err := mime.ParseMediaType(mimeType)
+        if err != nil {
+            continue
+        }
+        isText = isText || strings.HasPrefix(mediaType, "text/") || textMimeTypes[mediaType] || strings.HasSuffix(mediaType, "+json")
+        isHTML = isHTML || mediaType == "text/html"
+    }
+    if !isText {
+        return "", false
+    }
+
+    data, err := io.ReadAll(io.NewSectionReader(content, 0, maxIndexedText))
+    if err != nil {
+        return "", false
+    }
+    // Sniffed text/plain can still be binary; real text has no NULs
+    if bytes.IndexByte(data, 0) >= 0 {
+        return "", false
+    }
+
+    text := strings.ToValidUTF8(string(data), "")
+    if isHTML {
+        text = htmlTags.ReplaceAllString(text, " ")
+    }
+    return text, true
+}
+
+// extractDocumentText collects the character data of the XML parts of an Office/OpenDocument file
+func extractDocumentText(content io.ReaderAt, size int64, patterns []string) (string, bool) {
+    zr, err := zip.NewReader(content, size)
+    if err != nil {
+        return "", false
+    }
+
+    var names []string
+    files := make(map[string]*zip.File)
+    for _, f := range zr.File {
+        for _, pattern := range patterns {
+            if matched, _ := path.Match(pattern, f.Name); matched {
+                names = append(names, f.Name)
+                files[f.Name] = f
+            }
+        }
+    }
+    // slide10.xml sorts before slide2.xml, but the order only affects snippets
+    sort.Strings(names)
+
+    var text strings.Builder
+    for _, name := range names {
+        rc, err := files[name].Open()
+        if err != nil {
+            continue
+        }
+        decoder := xml.NewDecoder(io.LimitReader(rc, maxDocumentSize))
+        for text.Len() < maxIndexedText {
+            token, err := decoder.Token()
+            if err != nil {
+                break
+            }
+            switch t := token.(type) {
+            case xml.CharData:
+                text.Write(t)
+            case xml.EndElement:
+                // Paragraphs, cells and runs end here; keep their words apart
+                text.WriteByte(' ')
+            }
+        }
+        rc.Close()
+    }
+
+    result := text.String()
+    if len(result) > maxIndexedText {
+        result = strings.ToValidUTF8(result[:maxIndexedText], "")
+    }
+    return result, true
+}
+
+// SearchContent - Ranks files visible to userID (owned or public, not trashed) by content match
+func (fs *FileSystem) SearchContent(query string, userID uint, limit int) ([]SearchResult, error) {
+    var hits []struct {
+        ID      uint
+        Rank    float64
+        Snippet string
+    }
+    err := fs.DB.Raw(`SELECT file_nodes.id, ts_rank(dt.search_vector, q) AS rank,
+            ts_headline(?, dt.content, q, 'MaxFragments=2, MaxWords=20, MinWords=5') AS snippet
+        FROM file_nodes
+        JOIN document_texts dt ON dt.data_block_id = file_nodes.data_block_id,
+            websearch_to_tsquery(?, ?) q
+        WHERE dt.search_vector @@ q
+            AND file_nodes.trie_node_id IN (SELECT id FROM trie_nodes WHERE (owner_id = ? OR is_public = ?) AND trashed = ?)
+        ORDER BY rank DESC, file_nodes.id
+        LIMIT ?`,
+        searchConfig, searchConfig, query, userID, true, false, limit).Scan(&hits).Error
+    if err != nil {
+        return nil, err
+    }
+
+    ids := make([]uint, 0, len(hits))
+    for _, hit := range hits {
+        ids = append(ids, hit.ID)
+    }
+    var fileNodes []FileNode
+    if err := fs.DB.Preload("TrieNode").Where("id IN ?", ids).Find(&fileNodes).Error; err != nil {
+        return nil, err
+    }
+    byID := make(map[uint]FileNode, len(fileNodes))
+    for _, fileNode := range fileNodes {
+        byID[fileNode.ID] = fileNode
+    }
+
+    results := make([]SearchResult, 0, len(hits))
+    for _, hit := range hits {
+        if fileNode, ok := byID[hit.ID]; ok {
+            results = append(results, SearchResult{FileNode: fileNode, Rank: hit.Rank, Snippet: hit.Snippet})
+        }
+    }
+    return results, nil
+}
+
+// SearchFiles handles GET /api/search?q=...&limit=N
+func (app *App) SearchFiles(w http.ResponseWriter, r *http.Request) {
+    userID := app.getUserID(r)
+
+    query := strings.TrimSpace(r.URL.Query().Get("q"))
+    if query == "" {
+        http.Error(w, "q is required", http.StatusBadRequest)
+        return
+    }
+
+    limit := defaultSearchMax
+    if value := r.URL.Query().Get("limit"); value != "" {
+        n, err := strconv.Atoi(value)
+        if err != nil || n < 1 {
+            http.Error(w, "Invalid limit", http.StatusBadRequest)
+            return
+        }
+        if n > maxSearchResults {
+            n = maxSearchResults
+        }
+        limit = n
+    }
+
+    fs := NewFileSystem(app.DB, app.Blobs, app.Keys, userID)
+    results, err := fs.SearchContent(query, userID, limit)
+    if err != nil {
+        http.Error(w, "Search failed", http.StatusInternalServerError)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(results)
+}
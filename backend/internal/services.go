@@ -1,25 +1,32 @@
 package internal
 
 import (
+    "bytes"
     "crypto/sha256"
+    "encoding/hex"
     "errors"
     "fmt"
     "io"
-    "mime/multipart"
     "net/http"
+    "os"
     "path/filepath"
     "strings"
+    "time"
+    "unicode/utf8"
     
     "gorm.io/gorm"
+    "gorm.io/gorm/clause"
 )
 
 // FileSystem - Your C++ FileSystem class
 type FileSystem struct {
-    DB   *gorm.DB
-    Root *TrieNode
+    DB    *gorm.DB
+    Blobs BlobStore
+    Keys  *KeyRing // nil when encryption at rest is off
+    Root  *TrieNode
 }
 
-func NewFileSystem(db *gorm.DB, userID uint) *FileSystem {
+func NewFileSystem(db *gorm.DB, blobs BlobStore, keys *KeyRing, userID uint) *FileSystem {
     // Create or get root node for user
     var root TrieNode
     err := db.Where("name = ? AND owner_id = ? AND path = ?", "root", userID, "/").First(&root).Error
@@ -37,7 +44,7 @@ func NewFileSystem(db *gorm.DB, userID uint) *FileSystem {
         db.Create(dirNode)
     }
     
-    return &FileSystem{DB: db, Root: &root}
+    return &FileSystem{DB: db, Blobs: blobs, Keys: keys, Root: &root}
 }
 
 // Split - Your C++ split function
@@ -70,6 +77,10 @@ func (fs *FileSystem) Insert(filePath string, isFile bool, userID uint) (*TrieNo
         return nil, errors.New("invalid path: reserved characters not allowed")
     }
     
+    if isFile && len(pathParts) == 0 {
+        return nil, errors.New("a file can't be created at the root")
+    }
+    
     currentNode := fs.Root
     currentPath := ""
     
@@ -84,8 +95,12 @@ func (fs *FileSystem) Insert(filePath string, isFile bool, userID uint) (*TrieNo
         
         if err == nil {
             // Node exists
-            if isLastPart && isFile && existingNode.NodeType == "file" {
-                return nil, errors.New("file already exists")
+            // A file is always a new node, never attached to what is already there
+            if isLastPart && isFile {
+                if existingNode.NodeType == "file" {
+                    return nil, errors.New("file already exists")
+                }
+                return nil, fmt.Errorf("a %s already exists at this path", existingNode.NodeType)
             }
             if !isLastPart && existingNode.NodeType == "file" {
                 return nil, errors.New("cannot create file inside another file")
@@ -142,69 +157,114 @@ func (fs *FileSystem) Search(filePath string, userID uint) (*TrieNode, error) {
     return &node, err
 }
 
-// ListDirectory - Your C++ ls function
-func (fs *FileSystem) ListDirectory(dirPath string, userID uint) ([]interface{}, error) {
-    dirNode, err := fs.Search(dirPath, userID)
+// ListDirectory - Your C++ ls function. Symlinks along dirPath are followed; with
+// lstat a symlink at dirPath itself is listed as the link instead of its target.
+// Entries are sorted, filtered and paginated per opts.
+func (fs *FileSystem) ListDirectory(dirPath string, userID uint, lstat bool, opts ListOptions) ([]interface{}, Page, error) {
+    var page Page
+    dirNode, err := fs.Resolve(dirPath, !lstat, userID)
     if err != nil {
-        return nil, err
+        return nil, page, err
     }
     
-    if dirNode.NodeType == "file" {
-        var fileNode FileNode
-        fs.DB.Where("trie_node_id = ?", dirNode.ID).Preload("DataBlock").First(&fileNode)
-        return []interface{}{fileNode}, nil
+    if dirNode.NodeType != "directory" {
+        page.Total = 1
+        return []interface{}{fs.nodeEntry(*dirNode, userID, !lstat)}, page, nil
     }
     
+    query := fs.DB.Model(&TrieNode{}).
+        Joins("LEFT JOIN file_nodes ON file_nodes.trie_node_id = trie_nodes.id").
+        Where("trie_nodes.parent_id = ? AND trie_nodes.owner_id = ?", dirNode.ID, userID)
+    query = opts.filter(query, dirListColumns).Session(&gorm.Session{})
+    query.Count(&page.Total)
+    
+    query, err = opts.page(query, dirListColumns)
+    if err != nil {
+        return nil, page, err
+    }
     var children []TrieNode
-    fs.DB.Where("parent_id = ? AND owner_id = ?", dirNode.ID, userID).Find(&children)
+    if err := query.Select("trie_nodes.*").Find(&children).Error; err != nil {
+        return nil, page, err
+    }
+    
+    more := len(children) > opts.Limit
+    if more {
+        children = children[:opts.Limit]
+    }
     
     var results []interface{}
     for _, child := range children {
-        if child.NodeType == "file" {
-            var fileNode FileNode
-            fs.DB.Where("trie_node_id = ?", child.ID).Preload("DataBlock").First(&fileNode)
-            results = append(results, fileNode)
-        } else {
-            var dirNode DirNode
-            fs.DB.Where("trie_node_id = ?", child.ID).First(&dirNode)
-            results = append(results, dirNode)
+        results = append(results, fs.nodeEntry(child, userID, !lstat))
+    }
+    
+    if more {
+        last := children[len(children)-1]
+        var size int64
+        downloads := 0
+        if fileNode, ok := results[len(results)-1].(FileNode); ok {
+            size, downloads = fileNode.Size, fileNode.Downloads
         }
+        page.NextCursor = opts.encodeCursor(last.ID, last.Name, size, last.CreatedAt, downloads)
     }
     
-    return results, nil
+    return results, page, nil
 }
 
-// ProcessFileUpload - Enhanced with your deduplication logic
-func (fs *FileSystem) ProcessFileUpload(userID uint, fileHeader *multipart.FileHeader, dirPath string) (*FileNode, error) {
-    file, err := fileHeader.Open()
-    if err != nil {
-        return nil, err
+// nodeEntry loads the specialized node a listing shows for a TrieNode
+func (fs *FileSystem) nodeEntry(node TrieNode, userID uint, followLinks bool) interface{} {
+    switch node.NodeType {
+    case "file":
+        var fileNode FileNode
+        fs.DB.Where("trie_node_id = ?", node.ID).Preload("DataBlock").First(&fileNode)
+        return fileNode
+    case "symlink":
+        return fs.symlinkEntry(node, userID, followLinks)
+    default:
+        var dirNode DirNode
+        fs.DB.Where("trie_node_id = ?", node.ID).First(&dirNode)
+        return dirNode
     }
-    defer file.Close()
+}
 
-    // Read file data
-    data, err := io.ReadAll(file)
-    if err != nil {
+// UploadOptions - Per-upload behaviour switches
+type UploadOptions struct {
+    Versioning bool     // Re-uploading to an existing file adds a new version instead of failing
+    Metadata   Metadata // Set on new files, merged into versioned ones
+}
+
+// ProcessFileUpload - Enhanced with your deduplication logic, streamed so memory stays flat
+func (fs *FileSystem) ProcessFileUpload(userID uint, filename, declaredMime string, content io.Reader, dirPath string, opts UploadOptions) (*FileNode, error) {
+    if err := validateFileName(filename); err != nil {
         return nil, err
     }
-
+    
     // Check quota
     var user User
     if err := fs.DB.First(&user, userID).Error; err != nil {
         return nil, err
     }
-    if user.QuotaUsed+int64(len(data)) > user.QuotaMax {
-        return nil, errors.New("quota exceeded")
-    }
-
-    // Validate MIME type
-    actualMime := http.DetectContentType(data)
     
-    // Calculate SHA-256 hash (improved from your encrypt function)
-    hash := fs.calculateHash(data)
+    // Spool to disk while hashing; aborts as soon as the quota is exceeded
+    staged, err := fs.stageUpload(content, user.QuotaMax-user.QuotaUsed)
+    if err != nil {
+        return nil, err
+    }
+    defer staged.Remove()
     
     // Create file path
-    fullPath := filepath.Join(dirPath, fileHeader.Filename)
+    fullPath := filepath.Join(dirPath, filename)
+    
+    if opts.Versioning {
+        if parts := fs.SplitPath(fullPath); len(parts) > 0 {
+            if existing, err := fs.Search(joinPath(parts), userID); err == nil && existing.NodeType == "file" {
+                fileNode, err := fs.addVersion(existing, &user, staged, declaredMime)
+                if err == nil && len(opts.Metadata) > 0 {
+                    err = fs.UpdateMetadata(fileNode, opts.Metadata)
+                }
+                return fileNode, err
+            }
+        }
+    }
     
     // Insert into Trie structure
     trieNode, err := fs.Insert(fullPath, true, userID)
@@ -212,33 +272,10 @@ func (fs *FileSystem) ProcessFileUpload(userID uint, fileHeader *multipart.FileH
         return nil, err
     }
 
-    // Check for deduplication
-    var existingBlock DataBlock
-    isDeduped := false
-    savedSpace := int64(0)
-    
-    if err := fs.DB.Where("hash = ?", hash).First(&existingBlock).Error; err == nil {
-        // Deduplicated - increment ref count
-        existingBlock.RefCount++
-        fs.DB.Save(&existingBlock)
-        
-        isDeduped = true
-        savedSpace = int64(len(data))
-        
-        // Update user savings
-        user.StorageSaved += savedSpace
-    } else {
-        // New file - create data block
-        existingBlock = DataBlock{
-            Hash:     hash,
-            Data:     data,
-            Size:     int64(len(data)),
-            RefCount: 1,
-        }
-        fs.DB.Create(&existingBlock)
-        
-        // Update user quota
-        user.QuotaUsed += int64(len(data))
+    block, isDeduped, err := fs.acquireBlock(staged, filename, declaredMime, &user)
+    if err != nil {
+        fs.DB.Delete(trieNode)
+        return nil, err
     }
     
     fs.DB.Save(&user)
@@ -246,14 +283,17 @@ func (fs *FileSystem) ProcessFileUpload(userID uint, fileHeader *multipart.FileH
     // Create FileNode (your C++ FileNode)
     fileNode := &FileNode{
         TrieNodeID:     trieNode.ID,
-        OriginalName:   fileHeader.Filename,
-        Hash:           hash,
-        Size:           int64(len(data)),
-        MimeType:       fileHeader.Header.Get("Content-Type"),
-        ActualMimeType: actualMime,
-        DataBlockID:    existingBlock.ID,
+        OriginalName:   filename,
+        Hash:           staged.Hash,
+        Size:           staged.Size,
+        MimeType:       declaredMime,
+        ActualMimeType: staged.MimeType,
+        DataBlockID:    block.ID,
         RefCount:       1,
         IsDeduped:      isDeduped,
+        Metadata:       opts.Metadata,
+        Version:        1,
+        ModifiedAt:     time.Now(),
     }
 
     err = fs.DB.Create(fileNode).Error
@@ -261,6 +301,45 @@ func (fs *FileSystem) ProcessFileUpload(userID uint, fileHeader *multipart.FileH
     return fileNode, err
 }
 
+// acquireBlock takes a reference on the DataBlock holding staged content, storing and
+// indexing it first if it is new. A dedup hit is credited to user.StorageSaved, new data
+// is charged to user.QuotaUsed; the caller saves the user.
+func (fs *FileSystem) acquireBlock(staged *stagedUpload, filename, declaredMime string, user *User) (*DataBlock, bool, error) {
+    // Check for deduplication
+    var existingBlock DataBlock
+    
+    if err := fs.DB.Where("hash = ?", staged.Hash).First(&existingBlock).Error; err == nil {
+        // Deduplicated - increment ref count
+        existingBlock.RefCount++
+        fs.DB.Save(&existingBlock)
+        
+        // Update user savings
+        user.StorageSaved += staged.Size
+        return &existingBlock, true, nil
+    }
+    
+    // New file - record the data block, then store its chunks
+    existingBlock = DataBlock{
+        Hash:     staged.Hash,
+        Size:     staged.Size,
+        RefCount: 1,
+        Chunked:  true,
+    }
+    if err := fs.DB.Create(&existingBlock).Error; err != nil {
+        return nil, false, err
+    }
+    if err := fs.storeChunks(&existingBlock, staged.File, staged.MimeType); err != nil {
+        orphans, _ := fs.releaseDataBlock(&existingBlock)
+        fs.reclaimBlobs(orphans)
+        return nil, false, err
+    }
+    fs.indexDocument(&existingBlock, staged, filename, declaredMime)
+    
+    // Update user quota
+    user.QuotaUsed += staged.Size
+    return &existingBlock, false, nil
+}
+
 // DeleteFile - Your C++ deleteFile with reference counting
 func (fs *FileSystem) DeleteFile(filePath string, userID uint) error {
     trieNode, err := fs.Search(filePath, userID)
@@ -280,33 +359,190 @@ func (fs *FileSystem) DeleteFile(filePath string, userID uint) error {
     // Decrement file reference count (your C++ logic)
     fileNode.RefCount--
     
-    if fileNode.RefCount <= 0 {
-        // Decrement data block reference count
-        fileNode.DataBlock.RefCount--
+    if fileNode.RefCount > 0 {
+        return fs.DB.Save(&fileNode).Error
+    }
+    
+    var orphans []string
+    err = fs.DB.Transaction(func(tx *gorm.DB) error {
+        var err error
+        if orphans, err = fs.withTx(tx).releaseFileNode(&fileNode, userID); err != nil {
+            return err
+        }
+        if err := tx.Where("trie_node_id = ?", trieNode.ID).Delete(&NodeTag{}).Error; err != nil {
+            return err
+        }
+        return tx.Delete(trieNode).Error
+    })
+    if err != nil {
+        return err
+    }
+    
+    fs.reclaimBlobs(orphans)
+    return nil
+}
+
+var ErrDirectoryNotEmpty = errors.New("directory not empty")
+var ErrInvalidFileName = errors.New("invalid file name")
+
+// DeleteDirectory - Removes a directory, and with recursive its whole subtree, in one transaction
+func (fs *FileSystem) DeleteDirectory(dirPath string, recursive bool, userID uint) (int, error) {
+    pathParts := fs.SplitPath(dirPath)
+    if pathParts == nil {
+        return 0, errors.New("invalid path")
+    }
+    if len(pathParts) == 0 {
+        return 0, errors.New("cannot delete the root directory")
+    }
+    dirPath = joinPath(pathParts)
+    
+    var orphans []string
+    filesRemoved := 0
+    
+    err := fs.DB.Transaction(func(tx *gorm.DB) error {
+        txfs := fs.withTx(tx)
         
-        if fileNode.DataBlock.RefCount <= 0 {
-            // Delete actual data block
-            fs.DB.Delete(&fileNode.DataBlock)
-        } else {
-            fs.DB.Save(&fileNode.DataBlock)
+        dirNode, err := txfs.Search(dirPath, userID)
+        if err != nil {
+            return errors.New("directory not found")
+        }
+        if dirNode.NodeType != "directory" {
+            return errors.New("not a directory")
         }
         
-        // Delete file node and trie node
-        fs.DB.Delete(&fileNode)
-        fs.DB.Delete(trieNode)
+        if !recursive {
+            var children int64
+            tx.Model(&TrieNode{}).Where("parent_id = ?", dirNode.ID).Count(&children)
+            if children > 0 {
+                return ErrDirectoryNotEmpty
+            }
+        }
+        
+        orphans, filesRemoved, err = txfs.removeSubtree(dirNode, userID)
+        return err
+    })
+    if err != nil {
+        return 0, err
+    }
+    
+    fs.reclaimBlobs(orphans)
+    return filesRemoved, nil
+}
+
+// removeSubtree hard-deletes a node and everything under its path. Call it on a
+// transaction-bound FileSystem; returns blob keys to reclaim after commit.
+func (fs *FileSystem) removeSubtree(root *TrieNode, userID uint) ([]string, int, error) {
+    var subtree []TrieNode
+    err := fs.DB.Where("owner_id = ?", userID).Where(belowPath(root.Path)).Find(&subtree).Error
+    if err != nil {
+        return nil, 0, err
+    }
+    subtree = append(subtree, *root)
+    
+    var orphans []string
+    filesRemoved := 0
+    ids := make([]uint, 0, len(subtree))
+    for _, node := range subtree {
+        ids = append(ids, node.ID)
+        if node.NodeType != "file" {
+            continue
+        }
         
-        // Update user quota if not deduped
-        if !fileNode.IsDeduped {
-            var user User
-            fs.DB.First(&user, userID)
-            user.QuotaUsed -= fileNode.Size
-            fs.DB.Save(&user)
+        var fileNode FileNode
+        if err := fs.DB.Where("trie_node_id = ?", node.ID).Preload("DataBlock").First(&fileNode).Error; err != nil {
+            continue // trie node without content (e.g. an interrupted upload)
+        }
+        released, err := fs.releaseFileNode(&fileNode, userID)
+        if err != nil {
+            return nil, 0, err
         }
-    } else {
-        fs.DB.Save(&fileNode)
+        orphans = append(orphans, released...)
+        filesRemoved++
     }
     
-    return nil
+    if err := fs.DB.Where("trie_node_id IN ?", ids).Delete(&DirNode{}).Error; err != nil {
+        return nil, 0, err
+    }
+    if err := fs.DB.Where("trie_node_id IN ?", ids).Delete(&SymLinkNode{}).Error; err != nil {
+        return nil, 0, err
+    }
+    if err := fs.DB.Where("trie_node_id IN ?", ids).Delete(&NodeTag{}).Error; err != nil {
+        return nil, 0, err
+    }
+    if err := fs.DB.Where("id IN ?", ids).Delete(&TrieNode{}).Error; err != nil {
+        return nil, 0, err
+    }
+    return orphans, filesRemoved, nil
+}
+
+// releaseFileNode deletes a FileNode (not its TrieNode) and its retained versions,
+// dropping their data block references and returning quota. Returns blob keys to
+// reclaim after commit.
+func (fs *FileSystem) releaseFileNode(fileNode *FileNode, userID uint) ([]string, error) {
+    var versions []FileVersion
+    if err := fs.DB.Where("file_node_id = ?", fileNode.ID).Find(&versions).Error; err != nil {
+        return nil, err
+    }
+    
+    var orphans []string
+    for i := range versions {
+        released, err := fs.releaseVersion(&versions[i], userID)
+        if err != nil {
+            return nil, err
+        }
+        orphans = append(orphans, released...)
+    }
+    
+    // Shares point at the file node and would block its deletion
+    if err := fs.DB.Where("file_node_id = ?", fileNode.ID).Delete(&Share{}).Error; err != nil {
+        return nil, err
+    }
+    if err := fs.DB.Delete(fileNode).Error; err != nil {
+        return nil, err
+    }
+    
+    released, err := fs.releaseBlockRef(fileNode.DataBlockID, fileNode.Size, fileNode.IsDeduped, userID)
+    if err != nil {
+        return nil, err
+    }
+    return append(orphans, released...), nil
+}
+
+// releaseBlockRef drops one reference to a data block, deleting the block once nothing
+// references it, and returns quota when that reference was the one charged for the data
+func (fs *FileSystem) releaseBlockRef(blockID uint, size int64, isDeduped bool, userID uint) ([]string, error) {
+    var orphans []string
+    
+    // Reload: one transaction may release several references to the same block
+    var block DataBlock
+    if err := fs.DB.First(&block, blockID).Error; err != nil {
+        return nil, err
+    }
+    
+    // Decrement data block reference count
+    block.RefCount--
+    
+    if block.RefCount <= 0 {
+        // Delete actual data block and its chunks
+        released, err := fs.releaseDataBlock(&block)
+        if err != nil {
+            return nil, err
+        }
+        orphans = released
+    } else if err := fs.DB.Save(&block).Error; err != nil {
+        return nil, err
+    }
+    
+    // Update user quota if not deduped
+    if !isDeduped {
+        err := fs.DB.Model(&User{}).Where("id = ?", userID).
+            Update("quota_used", gorm.Expr("quota_used - ?", size)).Error
+        if err != nil {
+            return nil, err
+        }
+    }
+    
+    return orphans, nil
 }
 
 // CreateHardLink - Your C++ hardLink function
@@ -352,6 +588,7 @@ func (fs *FileSystem) CreateHardLink(srcFilePath, dstFilePath string, userID uin
         DataBlockID:    srcFileNode.DataBlockID,
         RefCount:       1,
         IsDeduped:      true, // Hard links are always considered deduped
+        ModifiedAt:     srcFileNode.ModifiedAt,
     }
     
     return fs.DB.Create(hardLinkFileNode).Error
@@ -378,34 +615,382 @@ func (fs *FileSystem) CreateSoftLink(srcFilePath, dstFilePath string, userID uin
     return fs.DB.Create(symLinkNode).Error
 }
 
+// Move - Renames or re-parents a node, rewriting the materialized path of its whole subtree
+func (fs *FileSystem) Move(srcPath, dstPath string, userID uint) (*TrieNode, error) {
+    srcParts := fs.SplitPath(srcPath)
+    dstParts := fs.SplitPath(dstPath)
+    if srcParts == nil || dstParts == nil {
+        return nil, errors.New("invalid path: reserved characters not allowed")
+    }
+    if len(srcParts) == 0 || len(dstParts) == 0 {
+        return nil, errors.New("cannot move the root directory")
+    }
+    srcPath = joinPath(srcParts)
+    dstPath = joinPath(dstParts)
+    
+    if dstPath == srcPath || strings.HasPrefix(dstPath, srcPath+"/") {
+        return nil, errors.New("cannot move a directory into itself")
+    }
+    
+    var moved *TrieNode
+    err := fs.DB.Transaction(func(tx *gorm.DB) error {
+        txfs := fs.withTx(tx)
+        
+        node, err := txfs.Search(srcPath, userID)
+        if err != nil {
+            return errors.New("source not found")
+        }
+        if _, err := txfs.Search(dstPath, userID); err == nil {
+            return errors.New("destination already exists")
+        }
+        
+        // Parent directories are created like Insert does for uploads
+        parent, err := txfs.Insert(joinPath(dstParts[:len(dstParts)-1]), false, userID)
+        if err != nil {
+            return err
+        }
+        if parent.NodeType != "directory" {
+            return errors.New("destination parent is not a directory")
+        }
+        
+        // Rewrite descendants first, while they still carry the old prefix
+        err = tx.Model(&TrieNode{}).
+            Where("owner_id = ?", userID).Where(belowPath(srcPath)).
+            Update("path", rebasePath(srcPath, dstPath)).Error
+        if err != nil {
+            return err
+        }
+        
+        node.Name = dstParts[len(dstParts)-1]
+        node.Path = dstPath
+        node.ParentID = &parent.ID
+        if err := tx.Save(node).Error; err != nil {
+            return err
+        }
+        
+        // Downloads are named after the file, so a rename carries over
+        if node.NodeType == "file" {
+            if err := tx.Model(&FileNode{}).Where("trie_node_id = ?", node.ID).Update("original_name", node.Name).Error; err != nil {
+                return err
+            }
+        }
+        
+        moved = node
+        return nil
+    })
+    
+    return moved, err
+}
+
+// Copy - Duplicates a file or subtree server-side; copies share DataBlocks like a dedup hit
+func (fs *FileSystem) Copy(srcPath, dstPath string, userID uint) (*TrieNode, error) {
+    srcParts := fs.SplitPath(srcPath)
+    dstParts := fs.SplitPath(dstPath)
+    if srcParts == nil || dstParts == nil {
+        return nil, errors.New("invalid path: reserved characters not allowed")
+    }
+    if len(srcParts) == 0 || len(dstParts) == 0 {
+        return nil, errors.New("cannot copy the root directory")
+    }
+    srcPath = joinPath(srcParts)
+    dstPath = joinPath(dstParts)
+    
+    if dstPath == srcPath || strings.HasPrefix(dstPath, srcPath+"/") {
+        return nil, errors.New("cannot copy a directory into itself")
+    }
+    
+    var copied *TrieNode
+    err := fs.DB.Transaction(func(tx *gorm.DB) error {
+        txfs := fs.withTx(tx)
+        
+        srcNode, err := txfs.Search(srcPath, userID)
+        if err != nil {
+            return errors.New("source not found")
+        }
+        if _, err := txfs.Search(dstPath, userID); err == nil {
+            return errors.New("destination already exists")
+        }
+        
+        // Parents before children, so every copy can point at its new parent
+        subtree := []TrieNode{*srcNode}
+        var descendants []TrieNode
+        err = tx.Where("owner_id = ?", userID).Where(belowPath(srcPath)).
+            Order("LENGTH(path)").Find(&descendants).Error
+        if err != nil {
+            return err
+        }
+        subtree = append(subtree, descendants...)
+        
+        var fileNodes []FileNode
+        ids := make([]uint, 0, len(subtree))
+        for _, node := range subtree {
+            ids = append(ids, node.ID)
+        }
+        if err := tx.Where("trie_node_id IN ?", ids).Find(&fileNodes).Error; err != nil {
+            return err
+        }
+        filesByTrieNode := make(map[uint]FileNode, len(fileNodes))
+        totalSize := int64(0)
+        for _, fileNode := range fileNodes {
+            filesByTrieNode[fileNode.TrieNodeID] = fileNode
+            totalSize += fileNode.Size
+        }
+        
+        // Same check as ProcessFileUpload: the copy must fit, even though a dedup hit
+        // only adds to StorageSaved, not QuotaUsed
+        var user User
+        if err := tx.First(&user, userID).Error; err != nil {
+            return err
+        }
+        if user.QuotaUsed+totalSize > user.QuotaMax {
+            return ErrQuotaExceeded
+        }
+        
+        parent, err := txfs.Insert(joinPath(dstParts[:len(dstParts)-1]), false, userID)
+        if err != nil {
+            return err
+        }
+        if parent.NodeType != "directory" {
+            return errors.New("destination parent is not a directory")
+        }
+        
+        newIDs := make(map[uint]uint, len(subtree))
+        for i, node := range subtree {
+            newNode := &TrieNode{
+                Name:     node.Name,
+                OwnerID:  userID,
+                NodeType: node.NodeType,
+                IsPublic: node.IsPublic,
+            }
+            if i == 0 {
+                newNode.Name = dstParts[len(dstParts)-1]
+                newNode.Path = dstPath
+                newNode.ParentID = &parent.ID
+            } else {
+                newParentID := newIDs[*node.ParentID]
+                newNode.Path = dstPath + strings.TrimPrefix(node.Path, srcPath)
+                newNode.ParentID = &newParentID
+            }
+            if err := tx.Create(newNode).Error; err != nil {
+                return err
+            }
+            newIDs[node.ID] = newNode.ID
+            if i == 0 {
+                copied = newNode
+            }
+            
+            if err := txfs.copyNodeContent(node, newNode, filesByTrieNode); err != nil {
+                return err
+            }
+        }
+        
+        if err := txfs.copyNodeTags(newIDs); err != nil {
+            return err
+        }
+        return tx.Model(&User{}).Where("id = ?", userID).
+            Update("storage_saved", gorm.Expr("storage_saved + ?", totalSize)).Error
+    })
+    
+    return copied, err
+}
+
+// copyNodeContent creates the specialized node (FileNode, DirNode, SymLinkNode) for a copy
+func (fs *FileSystem) copyNodeContent(src TrieNode, dst *TrieNode, files map[uint]FileNode) error {
+    switch src.NodeType {
+    case "file":
+        srcFile, ok := files[src.ID]
+        if !ok {
+            return nil
+        }
+        if err := fs.DB.Model(&DataBlock{}).Where("id = ?", srcFile.DataBlockID).
+            Update("ref_count", gorm.Expr("ref_count + 1")).Error; err != nil {
+            return err
+        }
+        
+        fileNode := &FileNode{
+            TrieNodeID:     dst.ID,
+            OriginalName:   srcFile.OriginalName,
+            Hash:           srcFile.Hash,
+            Size:           srcFile.Size,
+            MimeType:       srcFile.MimeType,
+            ActualMimeType: srcFile.ActualMimeType,
+            DataBlockID:    srcFile.DataBlockID,
+            RefCount:       1,
+            Tags:           srcFile.Tags,
+            Metadata:       srcFile.Metadata,
+            IsDeduped:      true, // Copies are dedup hits on the source's data block
+            ModifiedAt:     srcFile.ModifiedAt,
+        }
+        if dst.Name != src.Name {
+            fileNode.OriginalName = dst.Name
+        }
+        return fs.DB.Create(fileNode).Error
+        
+    case "symlink":
+        var link SymLinkNode
+        if err := fs.DB.Where("trie_node_id = ?", src.ID).First(&link).Error; err != nil {
+            return nil
+        }
+        return fs.DB.Create(&SymLinkNode{TrieNodeID: dst.ID, TargetPath: link.TargetPath}).Error
+        
+    default:
+        return fs.DB.Create(&DirNode{TrieNodeID: dst.ID}).Error
+    }
+}
+
 // GetDeduplicationStats returns deduplication statistics
 func (fs *FileSystem) GetDeduplicationStats() map[string]interface{} {
-    var totalFiles, totalBlocks int64
-    var totalLogicalSize, totalPhysicalSize, totalSaved int64
+    var totalFiles, totalBlocks, totalChunks int64
+    var totalLogicalSize, totalSaved int64
+    var wholeBlockSize, chunkPhysicalSize, chunkReferencedSize, chunkStoredSize int64
+    var compressedChunks, compressionSaved int64
 
     fs.DB.Model(&FileNode{}).Count(&totalFiles)
     fs.DB.Model(&DataBlock{}).Count(&totalBlocks)
+    fs.DB.Model(&Chunk{}).Count(&totalChunks)
     fs.DB.Model(&FileNode{}).Select("COALESCE(SUM(size), 0)").Scan(&totalLogicalSize)
-    fs.DB.Model(&DataBlock{}).Select("COALESCE(SUM(size), 0)").Scan(&totalPhysicalSize)
     fs.DB.Model(&User{}).Select("COALESCE(SUM(storage_saved), 0)").Scan(&totalSaved)
+    
+    // Physical size is what the blob store holds: legacy whole-file blocks plus unique chunks as stored
+    fs.DB.Model(&DataBlock{}).Where("chunked = ?", false).Select("COALESCE(SUM(size), 0)").Scan(&wholeBlockSize)
+    fs.DB.Model(&Chunk{}).Select("COALESCE(SUM(size), 0)").Scan(&chunkPhysicalSize)
+    fs.DB.Model(&BlockChunk{}).Select("COALESCE(SUM(size), 0)").Scan(&chunkReferencedSize)
+    fs.DB.Model(&Chunk{}).Select("COALESCE(SUM(stored_size), 0)").Scan(&chunkStoredSize)
+    
+    // Compression savings are measured after dedup, on unique chunks only
+    fs.DB.Model(&Chunk{}).Where("codec <> ?", CodecNone).Count(&compressedChunks)
+    fs.DB.Model(&Chunk{}).Where("codec <> ?", CodecNone).Select("COALESCE(SUM(size - stored_size), 0)").Scan(&compressionSaved)
+    totalPhysicalSize := wholeBlockSize + chunkStoredSize
+    chunkSaved := chunkReferencedSize - chunkPhysicalSize
 
     dedupRatio := float64(0)
     if totalLogicalSize > 0 {
         dedupRatio = float64(totalSaved) / float64(totalLogicalSize) * 100
     }
+    chunkRatio := float64(0)
+    if chunkReferencedSize > 0 {
+        chunkRatio = float64(chunkSaved) / float64(chunkReferencedSize) * 100
+    }
+    compressionRatio := float64(0)
+    if chunkPhysicalSize > 0 {
+        compressionRatio = float64(compressionSaved) / float64(chunkPhysicalSize) * 100
+    }
 
     return map[string]interface{}{
-        "total_files":         totalFiles,
-        "unique_blocks":       totalBlocks,
-        "logical_size":        totalLogicalSize,
-        "physical_size":       totalPhysicalSize,
-        "space_saved":         totalSaved,
-        "deduplication_ratio": dedupRatio,
-        "efficiency":          fmt.Sprintf("%.2f%%", dedupRatio),
+        "total_files":           totalFiles,
+        "unique_blocks":         totalBlocks,
+        "unique_chunks":         totalChunks,
+        "logical_size":          totalLogicalSize,
+        "physical_size":         totalPhysicalSize,
+        "space_saved":           totalSaved,
+        "deduplication_ratio":   dedupRatio,
+        "efficiency":            fmt.Sprintf("%.2f%%", dedupRatio),
+        "chunk_referenced_size": chunkReferencedSize,
+        "chunk_space_saved":     chunkSaved,
+        "chunk_dedup_ratio":     chunkRatio,
+        "compressed_chunks":     compressedChunks,
+        "compression_saved":     compressionSaved,
+        "compression_ratio":     compressionRatio,
     }
 }
 
 // Helper functions
+
+// withTx returns a FileSystem whose queries run inside tx
+func (fs *FileSystem) withTx(tx *gorm.DB) *FileSystem {
+    return &FileSystem{DB: tx, Blobs: fs.Blobs, Keys: fs.Keys, Root: fs.Root}
+}
+
+// joinPath builds the materialized path stored on TrieNode from SplitPath parts
+func joinPath(parts []string) string {
+    return "/" + strings.Join(parts, "/")
+}
+
+// validateFileName rejects upload names that aren't exactly one path component; joined
+// onto the target directory they would land on the directory itself or its parent
+func validateFileName(name string) error {
+    if strings.TrimSpace(name) == "" || name == "." || name == ".." || strings.ContainsAny(name, "/\\") {
+        return ErrInvalidFileName
+    }
+    return nil
+}
+
+// belowPath returns a condition and its argument matching the trie node paths strictly
+// below dir; starts_with compares whole strings, so multibyte names match too
+func belowPath(dir string) (string, string) {
+    return "starts_with(path, ?)", dir + "/"
+}
+
+// rebasePath returns an expression moving a path below oldDir to the same place below newDir
+func rebasePath(oldDir, newDir string) clause.Expr {
+    // SUBSTRING counts characters, not bytes
+    return gorm.Expr("? || SUBSTRING(path FROM ?)", newDir, utf8.RuneCountInString(oldDir)+1)
+}
+
+// stagedUpload - an upload spooled to a temp file, rewound and ready to store
+type stagedUpload struct {
+    File     *os.File
+    Hash     string
+    Size     int64
+    MimeType string
+}
+
+func (u *stagedUpload) Remove() {
+    u.File.Close()
+    os.Remove(u.File.Name())
+}
+
+// stageUpload copies content to a temp file, hashing incrementally and
+// sniffing the MIME type from the first 512 bytes
+func (fs *FileSystem) stageUpload(content io.Reader, limit int64) (*stagedUpload, error) {
+    content = &quotaReader{r: content, remaining: limit}
+    
+    head := make([]byte, 512)
+    n, err := io.ReadFull(content, head)
+    if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+        return nil, err
+    }
+    head = head[:n]
+    
+    tmp, err := os.CreateTemp("", "filevault-upload-*")
+    if err != nil {
+        return nil, err
+    }
+    staged := &stagedUpload{File: tmp, MimeType: http.DetectContentType(head)}
+    
+    hasher := sha256.New()
+    size, err := io.Copy(io.MultiWriter(tmp, hasher), io.MultiReader(bytes.NewReader(head), content))
+    if err != nil {
+        staged.Remove()
+        return nil, err
+    }
+    if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+        staged.Remove()
+        return nil, err
+    }
+    
+    staged.Hash = hex.EncodeToString(hasher.Sum(nil))
+    staged.Size = size
+    return staged, nil
+}
+
+var ErrQuotaExceeded = errors.New("quota exceeded")
+
+// quotaReader fails with ErrQuotaExceeded once more than remaining bytes are read
+type quotaReader struct {
+    r         io.Reader
+    remaining int64
+}
+
+func (q *quotaReader) Read(p []byte) (int, error) {
+    n, err := q.r.Read(p)
+    q.remaining -= int64(n)
+    if q.remaining < 0 {
+        return n, ErrQuotaExceeded
+    }
+    return n, err
+}
+
 func (fs *FileSystem) calculateHash(data []byte) string {
     hash := sha256.Sum256(data)
     return fmt.Sprintf("%x", hash)
@@ -0,0 +1,75 @@
+package internal
+
+import (
+    "strings"
+    "testing"
+)
+
+// substring mirrors Postgres SUBSTRING(s FROM n), which counts characters from 1
+func substring(s string, from int) string {
+    runes := []rune(s)
+    if from-1 > len(runes) {
+        return ""
+    }
+    return string(runes[from-1:])
+}
+
+func TestBelowPath(t *testing.T) {
+    tests := []struct {
+        dir, path string
+        below     bool
+    }{
+        {"/docs", "/docs/a.txt", true},
+        {"/docs", "/docs", false},
+        {"/docs", "/docs2/a.txt", false},
+        {"/Fotos/Über", "/Fotos/Über/Sommer/a.jpg", true},
+        {"/日本語", "/日本語/ファイル.txt", true},
+        {"/日本語", "/日本/x", false},
+    }
+    for _, tt := range tests {
+        cond, prefix := belowPath(tt.dir)
+        if cond != "starts_with(path, ?)" {
+            t.Fatalf("unexpected condition %q", cond)
+        }
+        if got := strings.HasPrefix(tt.path, prefix); got != tt.below {
+            t.Errorf("belowPath(%q) on %q = %v, want %v", tt.dir, tt.path, got, tt.below)
+        }
+    }
+}
+
+func TestRebasePathCountsCharacters(t *testing.T) {
+    tests := []struct {
+        oldDir, newDir, path, want string
+    }{
+        {"/docs", "/archive/docs", "/docs/a/b.txt", "/archive/docs/a/b.txt"},
+        {"/Fotos/Über", "/Bilder", "/Fotos/Über/Sommer/a.jpg", "/Bilder/Sommer/a.jpg"},
+        {"/日本語", "/x", "/日本語/ファイル.txt", "/x/ファイル.txt"},
+        {"/a", "/Überall", "/a/c", "/Überall/c"},
+    }
+    for _, tt := range tests {
+        expr := rebasePath(tt.oldDir, tt.newDir)
+        if expr.SQL != "? || SUBSTRING(path FROM ?)" || len(expr.Vars) != 2 {
+            t.Fatalf("unexpected expression %q %v", expr.SQL, expr.Vars)
+        }
+        got := expr.Vars[0].(string) + substring(tt.path, expr.Vars[1].(int))
+        if got != tt.want {
+            t.Errorf("rebasePath(%q, %q) on %q = %q, want %q", tt.oldDir, tt.newDir, tt.path, got, tt.want)
+        }
+    }
+}
+
+func TestValidateFileName(t *testing.T) {
+    valid := []string{"a.txt", ".env", "..hidden", "report v2.pdf", "日本語.txt"}
+    for _, name := range valid {
+        if err := validateFileName(name); err != nil {
+            t.Errorf("validateFileName(%q) = %v, want nil", name, err)
+        }
+    }
+
+    invalid := []string{"", " ", ".", "..", "a/b", "../a", "/", `a\b`, `..\..\x`}
+    for _, name := range invalid {
+        if err := validateFileName(name); err != ErrInvalidFileName {
+            t.Errorf("validateFileName(%q) = %v, want ErrInvalidFileName", name, err)
+        }
+    }
+}
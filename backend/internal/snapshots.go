@@ -0,0 +1,580 @@
+package internal
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "net/http"
+    "sort"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/gorilla/mux"
+    "gorm.io/gorm"
+)
+
+// Snapshots record a directory subtree as SnapshotEntry rows. File entries take a
+// reference on their DataBlock like a dedup hit, so taking one never copies content.
+
+// SnapshotDiff - Paths (relative to the snapshot root) that differ from the live tree
+type SnapshotDiff struct {
+    Added    []string `json:"added"`    // Only in the live tree
+    Removed  []string `json:"removed"`  // Only in the snapshot
+    Modified []string `json:"modified"` // Content, link target or node type changed
+}
+
+// CreateSnapshot - Freezes the subtree under dirPath
+func (fs *FileSystem) CreateSnapshot(dirPath, name string, userID uint) (*Snapshot, error) {
+    pathParts := fs.SplitPath(dirPath)
+    if pathParts == nil {
+        return nil, errors.New("invalid path")
+    }
+    dirPath = joinPath(pathParts)
+    if name == "" {
+        name = fmt.Sprintf("%s @ %s", dirPath, time.Now().UTC().Format(time.RFC3339))
+    }
+
+    var snapshot *Snapshot
+    err := fs.DB.Transaction(func(tx *gorm.DB) error {
+        txfs := fs.withTx(tx)
+
+        root, err := txfs.Search(dirPath, userID)
+        if err != nil {
+            return errors.New("path not found")
+        }
+        if root.NodeType != "directory" {
+            return errors.New("only directories can be snapshotted")
+        }
+
+        nodes, err := txfs.liveSubtree(root, userID)
+        if err != nil {
+            return err
+        }
+        ids := make([]uint, 0, len(nodes))
+        for _, node := range nodes {
+            ids = append(ids, node.ID)
+        }
+
+        var fileNodes []FileNode
+        var links []SymLinkNode
+        if err := tx.Where("trie_node_id IN ?", ids).Find(&fileNodes).Error; err != nil {
+            return err
+        }
+        if err := tx.Where("trie_node_id IN ?", ids).Find(&links).Error; err != nil {
+            return err
+        }
+        files := make(map[uint]FileNode, len(fileNodes))
+        for _, fileNode := range fileNodes {
+            files[fileNode.TrieNodeID] = fileNode
+        }
+        targets := make(map[uint]string, len(links))
+        for _, link := range links {
+            targets[link.TrieNodeID] = link.TargetPath
+        }
+        tagNames, err := txfs.nodeTagNames(ids)
+        if err != nil {
+            return err
+        }
+
+        snapshot = &Snapshot{OwnerID: userID, Name: name, RootPath: dirPath}
+        if err := tx.Create(snapshot).Error; err != nil {
+            return err
+        }
+
+        entries := make([]SnapshotEntry, 0, len(nodes))
+        blockRefs := make(map[uint]int)
+        for _, node := range nodes {
+            relPath := snapshotRelPath(root.Path, node.Path)
+            entry := SnapshotEntry{
+                SnapshotID: snapshot.ID,
+                Path:       relPath,
+                ParentPath: snapshotParentPath(relPath),
+                Name:       node.Name,
+                NodeType:   node.NodeType,
+                IsPublic:   node.IsPublic,
+                Tags:       tagNames[node.ID],
+            }
+
+            switch node.NodeType {
+            case "file":
+                fileNode, ok := files[node.ID]
+                if !ok {
+                    continue // trie node without content (e.g. an interrupted upload)
+                }
+                blockID := fileNode.DataBlockID
+                entry.Hash = fileNode.Hash
+                entry.Size = fileNode.Size
+                entry.MimeType = fileNode.MimeType
+                entry.ActualMimeType = fileNode.ActualMimeType
+                entry.DataBlockID = &blockID
+                entry.Metadata = fileNode.Metadata
+                entry.ModifiedAt = fileModTime(fileNode)
+
+                blockRefs[blockID]++
+                snapshot.FileCount++
+                snapshot.TotalSize += fileNode.Size
+            case "symlink":
+                entry.TargetPath = targets[node.ID]
+            }
+            entries = append(entries, entry)
+        }
+
+        for blockID, refs := range blockRefs {
+            if err := tx.Model(&DataBlock{}).Where("id = ?", blockID).
+                Update("ref_count", gorm.Expr("ref_count + ?", refs)).Error; err != nil {
+                return err
+            }
+        }
+        if len(entries) > 0 {
+            if err := tx.CreateInBatches(entries, 500).Error; err != nil {
+                return err
+            }
+        }
+
+        return tx.Model(snapshot).Updates(map[string]interface{}{
+            "file_count": snapshot.FileCount,
+            "total_size": snapshot.TotalSize,
+        }).Error
+    })
+
+    return snapshot, err
+}
+
+// DeleteSnapshot - Drops a snapshot and the DataBlock references it held
+func (fs *FileSystem) DeleteSnapshot(snapshot *Snapshot) error {
+    var orphans []string
+    err := fs.DB.Transaction(func(tx *gorm.DB) error {
+        var entries []SnapshotEntry
+        if err := tx.Where("snapshot_id = ? AND data_block_id IS NOT NULL", snapshot.ID).Find(&entries).Error; err != nil {
+            return err
+        }
+        if err := tx.Where("snapshot_id = ?", snapshot.ID).Delete(&SnapshotEntry{}).Error; err != nil {
+            return err
+        }
+
+        // Snapshot references were never charged to the quota
+        txfs := fs.withTx(tx)
+        for _, entry := range entries {
+            released, err := txfs.releaseBlockRef(*entry.DataBlockID, entry.Size, true, snapshot.OwnerID)
+            if err != nil {
+                return err
+            }
+            orphans = append(orphans, released...)
+        }
+        return tx.Delete(snapshot).Error
+    })
+    if err != nil {
+        return err
+    }
+
+    fs.reclaimBlobs(orphans)
+    return nil
+}
+
+// DiffSnapshot - Compares a snapshot with the live subtree at its root path
+func (fs *FileSystem) DiffSnapshot(snapshot *Snapshot) (*SnapshotDiff, error) {
+    var entries []SnapshotEntry
+    if err := fs.DB.Where("snapshot_id = ?", snapshot.ID).Find(&entries).Error; err != nil {
+        return nil, err
+    }
+    then := make(map[string]string, len(entries))
+    for _, entry := range entries {
+        then[entry.Path] = snapshotEntryKey(entry.NodeType, entry.Hash, entry.TargetPath)
+    }
+
+    now := make(map[string]string)
+    if root, err := fs.Search(snapshot.RootPath, snapshot.OwnerID); err == nil && root.NodeType == "directory" {
+        nodes, err := fs.liveSubtree(root, snapshot.OwnerID)
+        if err != nil {
+            return nil, err
+        }
+        ids := make([]uint, 0, len(nodes))
+        for _, node := range nodes {
+            ids = append(ids, node.ID)
+        }
+
+        var fileNodes []FileNode
+        var links []SymLinkNode
+        fs.DB.Where("trie_node_id IN ?", ids).Find(&fileNodes)
+        fs.DB.Where("trie_node_id IN ?", ids).Find(&links)
+        hashes := make(map[uint]string, len(fileNodes))
+        for _, fileNode := range fileNodes {
+            hashes[fileNode.TrieNodeID] = fileNode.Hash
+        }
+        targets := make(map[uint]string, len(links))
+        for _, link := range links {
+            targets[link.TrieNodeID] = link.TargetPath
+        }
+
+        for _, node := range nodes {
+            now[snapshotRelPath(root.Path, node.Path)] = snapshotEntryKey(node.NodeType, hashes[node.ID], targets[node.ID])
+        }
+    }
+
+    diff := &SnapshotDiff{Added: []string{}, Removed: []string{}, Modified: []string{}}
+    for path, key := range now {
+        if old, ok := then[path]; !ok {
+            diff.Added = append(diff.Added, path)
+        } else if old != key {
+            diff.Modified = append(diff.Modified, path)
+        }
+    }
+    for path := range then {
+        if _, ok := now[path]; !ok {
+            diff.Removed = append(diff.Removed, path)
+        }
+    }
+    sort.Strings(diff.Added)
+    sort.Strings(diff.Removed)
+    sort.Strings(diff.Modified)
+
+    return diff, nil
+}
+
+// RestoreSnapshot - Recreates a snapshot's subtree at destPath (its root path by default).
+// Whatever currently lives there is moved to the trash first, so a restore can be undone.
+func (fs *FileSystem) RestoreSnapshot(snapshot *Snapshot, destPath string, userID uint) (*TrieNode, error) {
+    if destPath == "" {
+        destPath = snapshot.RootPath
+    }
+    dstParts := fs.SplitPath(destPath)
+    if dstParts == nil {
+        return nil, errors.New("invalid restore path")
+    }
+    destPath = joinPath(dstParts)
+
+    var dest *TrieNode
+    err := fs.DB.Transaction(func(tx *gorm.DB) error {
+        txfs := fs.withTx(tx)
+
+        // Parents before children, so every node can point at its restored parent
+        var entries []SnapshotEntry
+        if err := tx.Where("snapshot_id = ?", snapshot.ID).Order("LENGTH(path)").Find(&entries).Error; err != nil {
+            return err
+        }
+
+        // Same check as Copy: restored files are dedup hits but must still fit
+        var user User
+        if err := tx.First(&user, userID).Error; err != nil {
+            return err
+        }
+        if user.QuotaUsed+snapshot.TotalSize > user.QuotaMax {
+            return ErrQuotaExceeded
+        }
+
+        existing, err := txfs.Search(destPath, userID)
+        if err == nil && existing.NodeType == "directory" {
+            var children []TrieNode
+            if err := tx.Where("parent_id = ? AND owner_id = ?", existing.ID, userID).Find(&children).Error; err != nil {
+                return err
+            }
+            for _, child := range children {
+                if _, err := txfs.Trash(child.Path, true, userID); err != nil {
+                    return err
+                }
+            }
+            dest = existing
+        } else {
+            if err == nil {
+                if _, err := txfs.Trash(existing.Path, true, userID); err != nil {
+                    return err
+                }
+            }
+            if dest, err = txfs.Insert(destPath, false, userID); err != nil {
+                return err
+            }
+            if dest.NodeType != "directory" {
+                return errors.New("restore path is not a directory")
+            }
+        }
+
+        restoredIDs := map[string]uint{"/": dest.ID}
+        for _, entry := range entries {
+            parentID, ok := restoredIDs[entry.ParentPath]
+            if !ok {
+                continue
+            }
+            node := &TrieNode{
+                Name:     entry.Name,
+                Path:     strings.TrimSuffix(dest.Path, "/") + entry.Path,
+                ParentID: &parentID,
+                OwnerID:  userID,
+                NodeType: entry.NodeType,
+                IsPublic: entry.IsPublic,
+            }
+            if err := tx.Create(node).Error; err != nil {
+                return err
+            }
+            restoredIDs[entry.Path] = node.ID
+
+            if err := txfs.restoreEntryContent(entry, node); err != nil {
+                return err
+            }
+            if entry.Tags != "" {
+                if _, err := txfs.tagNodes([]uint{node.ID}, splitTags(entry.Tags), userID); err != nil {
+                    return err
+                }
+            }
+        }
+
+        return tx.Model(&User{}).Where("id = ?", userID).
+            Update("storage_saved", gorm.Expr("storage_saved + ?", snapshot.TotalSize)).Error
+    })
+
+    return dest, err
+}
+
+// restoreEntryContent creates the specialized node (FileNode, DirNode, SymLinkNode) for a restored entry
+func (fs *FileSystem) restoreEntryContent(entry SnapshotEntry, node *TrieNode) error {
+    switch entry.NodeType {
+    case "file":
+        if entry.DataBlockID == nil {
+            return nil
+        }
+        if err := fs.DB.Model(&DataBlock{}).Where("id = ?", *entry.DataBlockID).
+            Update("ref_count", gorm.Expr("ref_count + 1")).Error; err != nil {
+            return err
+        }
+        return fs.DB.Create(&FileNode{
+            TrieNodeID:     node.ID,
+            OriginalName:   entry.Name,
+            Hash:           entry.Hash,
+            Size:           entry.Size,
+            MimeType:       entry.MimeType,
+            ActualMimeType: entry.ActualMimeType,
+            DataBlockID:    *entry.DataBlockID,
+            RefCount:       1,
+            Tags:           entry.Tags,
+            Metadata:       entry.Metadata,
+            IsDeduped:      true, // Shares the snapshot's data block
+            ModifiedAt:     entry.ModifiedAt,
+        }).Error
+
+    case "symlink":
+        return fs.DB.Create(&SymLinkNode{TrieNodeID: node.ID, TargetPath: entry.TargetPath}).Error
+
+    default:
+        return fs.DB.Create(&DirNode{TrieNodeID: node.ID}).Error
+    }
+}
+
+// liveSubtree returns the untrashed descendants of root, parents before children
+func (fs *FileSystem) liveSubtree(root *TrieNode, userID uint) ([]TrieNode, error) {
+    var nodes []TrieNode
+    err := fs.DB.Where("owner_id = ? AND trashed = ? AND id <> ?", userID, false, root.ID).
+        Where(belowPath(strings.TrimSuffix(root.Path, "/"))).
+        Order("LENGTH(path)").Find(&nodes).Error
+    return nodes, err
+}
+
+// snapshotRelPath maps a live path to its path relative to the snapshot root
+func snapshotRelPath(rootPath, nodePath string) string {
+    return strings.TrimPrefix(nodePath, strings.TrimSuffix(rootPath, "/"))
+}
+
+func snapshotParentPath(relPath string) string {
+    if i := strings.LastIndex(relPath, "/"); i > 0 {
+        return relPath[:i]
+    }
+    return "/"
+}
+
+func snapshotEntryKey(nodeType, hash, targetPath string) string {
+    switch nodeType {
+    case "file":
+        return "file:" + hash
+    case "symlink":
+        return "symlink:" + targetPath
+    default:
+        return nodeType
+    }
+}
+
+// Snapshot handlers
+func (app *App) CreateSnapshot(w http.ResponseWriter, r *http.Request) {
+    userID := app.getUserID(r)
+
+    var req struct {
+        Path string `json:"path"`
+        Name string `json:"name,omitempty"`
+    }
+    json.NewDecoder(r.Body).Decode(&req)
+    if req.Path == "" {
+        req.Path = "/"
+    }
+
+    fs := NewFileSystem(app.DB, app.Blobs, app.Keys, userID)
+    snapshot, err := fs.CreateSnapshot(req.Path, req.Name, userID)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(http.StatusCreated)
+    json.NewEncoder(w).Encode(snapshot)
+}
+
+// ListSnapshots returns the user's snapshots, optionally only those of ?path=
+func (app *App) ListSnapshots(w http.ResponseWriter, r *http.Request) {
+    userID := app.getUserID(r)
+
+    query := app.DB.Where("owner_id = ?", userID)
+    if path := r.URL.Query().Get("path"); path != "" {
+        query = query.Where("root_path = ?", path)
+    }
+
+    var snapshots []Snapshot
+    query.Order("created_at desc").Find(&snapshots)
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(snapshots)
+}
+
+// BrowseSnapshot lists the entries directly under ?path= (relative to the snapshot root)
+func (app *App) BrowseSnapshot(w http.ResponseWriter, r *http.Request) {
+    snapshot, ok := app.ownedSnapshot(w, r)
+    if !ok {
+        return
+    }
+
+    dirPath, ok := app.snapshotPath(w, r, snapshot, "directory")
+    if !ok {
+        return
+    }
+
+    var entries []SnapshotEntry
+    app.DB.Where("snapshot_id = ? AND parent_path = ?", snapshot.ID, dirPath).Order("name").Find(&entries)
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "snapshot": snapshot,
+        "path":     dirPath,
+        "entries":  entries,
+    })
+}
+
+func (app *App) DownloadSnapshotFile(w http.ResponseWriter, r *http.Request) {
+    snapshot, ok := app.ownedSnapshot(w, r)
+    if !ok {
+        return
+    }
+
+    filePath, ok := app.snapshotPath(w, r, snapshot, "file")
+    if !ok {
+        return
+    }
+
+    var entry SnapshotEntry
+    app.DB.Where("snapshot_id = ? AND path = ?", snapshot.ID, filePath).First(&entry)
+
+    var block DataBlock
+    if entry.DataBlockID == nil || app.DB.First(&block, *entry.DataBlockID).Error != nil {
+        http.Error(w, "File content unavailable", http.StatusNotFound)
+        return
+    }
+
+    app.serveFile(w, r, FileNode{
+        OriginalName:   entry.Name,
+        Hash:           entry.Hash,
+        Size:           entry.Size,
+        ActualMimeType: entry.ActualMimeType,
+        DataBlock:      block,
+        ModifiedAt:     entry.ModifiedAt,
+    })
+}
+
+func (app *App) DiffSnapshot(w http.ResponseWriter, r *http.Request) {
+    snapshot, ok := app.ownedSnapshot(w, r)
+    if !ok {
+        return
+    }
+
+    fs := NewFileSystem(app.DB, app.Blobs, app.Keys, snapshot.OwnerID)
+    diff, err := fs.DiffSnapshot(snapshot)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(diff)
+}
+
+func (app *App) RestoreSnapshot(w http.ResponseWriter, r *http.Request) {
+    snapshot, ok := app.ownedSnapshot(w, r)
+    if !ok {
+        return
+    }
+
+    var req struct {
+        DestPath string `json:"dest_path,omitempty"`
+    }
+    json.NewDecoder(r.Body).Decode(&req)
+
+    fs := NewFileSystem(app.DB, app.Blobs, app.Keys, snapshot.OwnerID)
+    node, err := fs.RestoreSnapshot(snapshot, req.DestPath, snapshot.OwnerID)
+    if err == ErrQuotaExceeded {
+        http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+        return
+    }
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(node)
+}
+
+func (app *App) DeleteSnapshot(w http.ResponseWriter, r *http.Request) {
+    snapshot, ok := app.ownedSnapshot(w, r)
+    if !ok {
+        return
+    }
+
+    fs := NewFileSystem(app.DB, app.Blobs, app.Keys, snapshot.OwnerID)
+    if err := fs.DeleteSnapshot(snapshot); err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]string{"message": "Snapshot deleted"})
+}
+
+func (app *App) ownedSnapshot(w http.ResponseWriter, r *http.Request) (*Snapshot, bool) {
+    snapshotID, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+    var snapshot Snapshot
+    if err := app.DB.Where("id = ? AND owner_id = ?", snapshotID, app.getUserID(r)).First(&snapshot).Error; err != nil {
+        http.Error(w, "Snapshot not found", http.StatusNotFound)
+        return nil, false
+    }
+    return &snapshot, true
+}
+
+// snapshotPath validates ?path= and checks the snapshot holds a nodeType entry there
+func (app *App) snapshotPath(w http.ResponseWriter, r *http.Request, snapshot *Snapshot, nodeType string) (string, bool) {
+    fs := NewFileSystem(app.DB, app.Blobs, app.Keys, snapshot.OwnerID)
+    pathParts := fs.SplitPath(r.URL.Query().Get("path"))
+    if pathParts == nil {
+        http.Error(w, "Invalid path", http.StatusBadRequest)
+        return "", false
+    }
+    relPath := joinPath(pathParts)
+
+    // The snapshot root itself has no entry
+    if relPath == "/" && nodeType == "directory" {
+        return relPath, true
+    }
+
+    var count int64
+    app.DB.Model(&SnapshotEntry{}).Where("snapshot_id = ? AND path = ? AND node_type = ?", snapshot.ID, relPath, nodeType).Count(&count)
+    if count == 0 {
+        http.Error(w, "Path not found in snapshot", http.StatusNotFound)
+        return "", false
+    }
+    return relPath, true
+}
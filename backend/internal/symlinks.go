@@ -0,0 +1,204 @@
+package internal
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "net/http"
+    "strings"
+
+    "gorm.io/gorm"
+)
+
+// Same limit as Linux's MAXSYMLINKS
+const maxSymlinkHops = 40
+
+var ErrSymlinkLoop = errors.New("too many levels of symbolic links")
+var ErrDanglingSymlink = errors.New("symbolic link target does not exist")
+
+const (
+    SymlinkOK       = "ok"
+    SymlinkDangling = "dangling"
+    SymlinkLoop     = "loop"
+)
+
+// SymlinkEntry - How listings show a symlink: the link, whether it resolves, and
+// (when following links) the node it resolves to
+type SymlinkEntry struct {
+    SymLinkNode
+    Status       string      `json:"status"` // "ok", "dangling" or "loop"
+    ResolvedPath string      `json:"resolved_path,omitempty"`
+    Target       interface{} `json:"target,omitempty"`
+}
+
+// Resolve - Search that follows symlinks in every path component, like stat(2).
+// With followFinal false a symlink in the last component is returned itself, like lstat(2).
+// Link targets are absolute paths in the owner's tree.
+func (fs *FileSystem) Resolve(filePath string, followFinal bool, userID uint) (*TrieNode, error) {
+    parts := fs.SplitPath(filePath)
+    if parts == nil {
+        return nil, errors.New("invalid path")
+    }
+    return fs.resolveParts(parts, followFinal, dbNodeLookup{db: fs.DB, userID: userID})
+}
+
+// nodeLookup is what path resolution reads from the trie
+type nodeLookup interface {
+    child(parentID uint, name string) (*TrieNode, error)
+    linkTarget(nodeID uint) (string, error)
+}
+
+// dbNodeLookup reads one user's trie from the database
+type dbNodeLookup struct {
+    db     *gorm.DB
+    userID uint
+}
+
+func (l dbNodeLookup) child(parentID uint, name string) (*TrieNode, error) {
+    var child TrieNode
+    err := l.db.Where("name = ? AND parent_id = ? AND owner_id = ?", name, parentID, l.userID).First(&child).Error
+    return &child, err
+}
+
+func (l dbNodeLookup) linkTarget(nodeID uint) (string, error) {
+    var link SymLinkNode
+    err := l.db.Where("trie_node_id = ?", nodeID).First(&link).Error
+    return link.TargetPath, err
+}
+
+// resolveParts walks parts from the root, following symlinks as Resolve describes
+func (fs *FileSystem) resolveParts(parts []string, followFinal bool, lookup nodeLookup) (*TrieNode, error) {
+    node := fs.Root
+    hops := 0
+    targetParts := 0 // Leading components of parts that came from a link target
+    seen := make(map[string]bool)
+
+    for len(parts) > 0 {
+        name := parts[0]
+        parts = parts[1:]
+        fromTarget := targetParts > 0
+        if fromTarget {
+            targetParts--
+        }
+
+        child, err := lookup.child(node.ID, name)
+        if err != nil {
+            if fromTarget {
+                return nil, ErrDanglingSymlink
+            }
+            return nil, errors.New("path not found")
+        }
+
+        if child.NodeType != "symlink" || (len(parts) == 0 && !followFinal) {
+            node = child
+            continue
+        }
+
+        // The same link reached with the same remainder can only repeat forever
+        visit := fmt.Sprintf("%d:%s", child.ID, strings.Join(parts, "/"))
+        hops++
+        if hops > maxSymlinkHops || seen[visit] {
+            return nil, ErrSymlinkLoop
+        }
+        seen[visit] = true
+
+        target, err := lookup.linkTarget(child.ID)
+        if err != nil {
+            return nil, ErrDanglingSymlink
+        }
+        linkParts := fs.SplitPath(target)
+        if linkParts == nil {
+            return nil, ErrDanglingSymlink
+        }
+
+        parts = append(append([]string{}, linkParts...), parts...)
+        targetParts = len(linkParts)
+        node = fs.Root
+    }
+
+    return node, nil
+}
+
+// symlinkEntry describes a symlink node, resolving it to report its status
+func (fs *FileSystem) symlinkEntry(node TrieNode, userID uint, withTarget bool) SymlinkEntry {
+    var entry SymlinkEntry
+    fs.DB.Where("trie_node_id = ?", node.ID).First(&entry.SymLinkNode)
+    entry.TrieNode = node
+
+    target, err := fs.Resolve(node.Path, true, userID)
+    switch {
+    case err == nil:
+        entry.Status = SymlinkOK
+        entry.ResolvedPath = target.Path
+        if withTarget {
+            entry.Target = fs.nodeEntry(*target, userID, false)
+        }
+    case errors.Is(err, ErrSymlinkLoop):
+        entry.Status = SymlinkLoop
+    default:
+        entry.Status = SymlinkDangling
+    }
+    return entry
+}
+
+// resolveErrorStatus maps path resolution errors to HTTP status codes
+func resolveErrorStatus(err error) int {
+    if errors.Is(err, ErrSymlinkLoop) {
+        return http.StatusLoopDetected
+    }
+    return http.StatusNotFound
+}
+
+// StatPath describes the node at ?path=, following symlinks unless ?lstat=true
+func (app *App) StatPath(w http.ResponseWriter, r *http.Request) {
+    userID := app.getUserID(r)
+    filePath := r.URL.Query().Get("path")
+    if filePath == "" {
+        filePath = "/"
+    }
+    lstat := r.URL.Query().Get("lstat") == "true"
+
+    fs := NewFileSystem(app.DB, app.Blobs, app.Keys, userID)
+    node, err := fs.Resolve(filePath, !lstat, userID)
+    if err != nil {
+        http.Error(w, err.Error(), resolveErrorStatus(err))
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "path":          filePath,
+        "resolved_path": node.Path,
+        "node_type":     node.NodeType,
+        "entry":         fs.nodeEntry(*node, userID, false),
+    })
+}
+
+// DownloadByPath serves the file at ?path=, following symlinks
+func (app *App) DownloadByPath(w http.ResponseWriter, r *http.Request) {
+    userID := app.getUserID(r)
+
+    fs := NewFileSystem(app.DB, app.Blobs, app.Keys, userID)
+    node, err := fs.Resolve(r.URL.Query().Get("path"), true, userID)
+    if err != nil {
+        http.Error(w, err.Error(), resolveErrorStatus(err))
+        return
+    }
+    if node.NodeType != "file" {
+        http.Error(w, "Path is not a file", http.StatusBadRequest)
+        return
+    }
+
+    var fileNode FileNode
+    if err := app.DB.Preload("DataBlock").Where("trie_node_id = ?", node.ID).First(&fileNode).Error; err != nil {
+        http.Error(w, "File not found", http.StatusNotFound)
+        return
+    }
+
+    // Increment download counter (HEAD, 304s and resumed ranges don't count)
+    if isFullDownload(r, fileNode) {
+        app.DB.Model(&fileNode).Update("downloads", fileNode.Downloads+1)
+    }
+
+    app.serveFile(w, r, fileNode)
+}
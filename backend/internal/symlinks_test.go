@@ -0,0 +1,142 @@
+package internal
+
+import (
+    "errors"
+    "fmt"
+    "strings"
+    "testing"
+)
+
+// memTree is an in-memory trie for exercising path resolution
+type memTree struct {
+    nodes   map[string]*TrieNode // "parentID/name"
+    targets map[uint]string
+    nextID  uint
+}
+
+func newMemTree() (*memTree, *FileSystem) {
+    root := &TrieNode{ID: 1, Name: "", Path: "/", NodeType: "directory"}
+    return &memTree{nodes: make(map[string]*TrieNode), targets: make(map[uint]string), nextID: 2},
+        &FileSystem{Root: root}
+}
+
+// add creates path and any missing parent directories; target makes it a symlink
+func (m *memTree) add(path, nodeType, target string) {
+    parentID := uint(1)
+    parts := strings.Split(strings.TrimPrefix(path, "/"), "/")
+    for i, name := range parts {
+        key := fmt.Sprintf("%d/%s", parentID, name)
+        node, ok := m.nodes[key]
+        if !ok {
+            node = &TrieNode{ID: m.nextID, Name: name, Path: "/" + strings.Join(parts[:i+1], "/"), NodeType: "directory"}
+            m.nextID++
+            m.nodes[key] = node
+        }
+        if i == len(parts)-1 {
+            node.NodeType = nodeType
+            if nodeType == "symlink" {
+                m.targets[node.ID] = target
+            }
+        }
+        parentID = node.ID
+    }
+}
+
+func (m *memTree) child(parentID uint, name string) (*TrieNode, error) {
+    if node, ok := m.nodes[fmt.Sprintf("%d/%s", parentID, name)]; ok {
+        return node, nil
+    }
+    return nil, errors.New("not found")
+}
+
+func (m *memTree) linkTarget(nodeID uint) (string, error) {
+    if target, ok := m.targets[nodeID]; ok {
+        return target, nil
+    }
+    return "", errors.New("not found")
+}
+
+func TestResolveParts(t *testing.T) {
+    tree, fs := newMemTree()
+    tree.add("/docs/report.txt", "file", "")
+    tree.add("/docs/latest", "symlink", "/docs/report.txt")
+    tree.add("/shortcut", "symlink", "/docs")
+    tree.add("/chain", "symlink", "/shortcut/latest")
+    tree.add("/dangling", "symlink", "/missing/file")
+    tree.add("/invalid", "symlink", "/docs/../etc")
+    tree.add("/self", "symlink", "/self")
+    tree.add("/ping", "symlink", "/pong")
+    tree.add("/pong", "symlink", "/ping")
+    tree.add("/back", "symlink", "/")
+
+    tests := []struct {
+        path        string
+        followFinal bool
+        want        string // Resolved path, or "" when an error is expected
+        wantErr     error
+    }{
+        {"/docs/report.txt", true, "/docs/report.txt", nil},
+        {"/", true, "/", nil},
+        {"/docs/latest", true, "/docs/report.txt", nil},
+        {"/docs/latest", false, "/docs/latest", nil},
+        {"/shortcut/report.txt", false, "/docs/report.txt", nil},
+        {"/shortcut/latest", true, "/docs/report.txt", nil},
+        {"/chain", true, "/docs/report.txt", nil},
+        {"/back/back/back/docs", true, "/docs", nil},
+        {"/dangling", true, "", ErrDanglingSymlink},
+        {"/dangling", false, "/dangling", nil},
+        {"/invalid", true, "", ErrDanglingSymlink},
+        {"/self", true, "", ErrSymlinkLoop},
+        {"/self/x", false, "", ErrSymlinkLoop},
+        {"/ping", true, "", ErrSymlinkLoop},
+        {"/ping", false, "/ping", nil},
+    }
+    for _, tt := range tests {
+        t.Run(fmt.Sprintf("%s follow=%v", tt.path, tt.followFinal), func(t *testing.T) {
+            node, err := fs.resolveParts(fs.SplitPath(tt.path), tt.followFinal, tree)
+            if tt.wantErr != nil {
+                if !errors.Is(err, tt.wantErr) {
+                    t.Fatalf("err = %v, want %v", err, tt.wantErr)
+                }
+                return
+            }
+            if err != nil {
+                t.Fatal(err)
+            }
+            if node.Path != tt.want {
+                t.Errorf("resolved to %s, want %s", node.Path, tt.want)
+            }
+        })
+    }
+
+    // A missing component of the path itself is not a dangling link
+    _, err := fs.resolveParts(fs.SplitPath("/nope/x"), true, tree)
+    if err == nil || errors.Is(err, ErrDanglingSymlink) {
+        t.Errorf("missing path err = %v", err)
+    }
+}
+
+func TestResolvePartsHopLimit(t *testing.T) {
+    tree, fs := newMemTree()
+    tree.add("/target", "file", "")
+    // /link0 -> /link1 -> ... -> /linkN -> /target: N+1 hops
+    build := func(prefix string, hops int) {
+        for i := 0; i < hops; i++ {
+            target := fmt.Sprintf("/%s%d", prefix, i+1)
+            if i == hops-1 {
+                target = "/target"
+            }
+            tree.add(fmt.Sprintf("/%s%d", prefix, i), "symlink", target)
+        }
+    }
+    build("ok", maxSymlinkHops)
+    build("long", maxSymlinkHops+1)
+
+    node, err := fs.resolveParts([]string{"ok0"}, true, tree)
+    if err != nil || node.Path != "/target" {
+        t.Errorf("%d hops: %v, %v", maxSymlinkHops, node, err)
+    }
+    if _, err := fs.resolveParts([]string{"long0"}, true, tree); !errors.Is(err, ErrSymlinkLoop) {
+        t.Errorf("%d hops: err = %v, want ErrSymlinkLoop", maxSymlinkHops+1, err)
+    }
+}
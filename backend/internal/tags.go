@@ -0,0 +1,525 @@
+package internal
+
+import (
+    "encoding/json"
+    "errors"
+    "log"
+    "net/http"
+    "sort"
+    "strconv"
+    "strings"
+    "unicode/utf8"
+
+    "github.com/gorilla/mux"
+    "gorm.io/gorm"
+    "gorm.io/gorm/clause"
+)
+
+// Tags are per-user labels linked to trie nodes, so files, directories and symlinks
+// can all carry them. FileNode.Tags mirrors a file's tag names for listings.
+const (
+    maxTagLength      = 64
+    defaultTagSuggest = 20
+    maxTagSuggest     = 100
+)
+
+var ErrInvalidTag = errors.New("tag names must be 1-64 characters without commas")
+var ErrTagNotFound = errors.New("tag not found")
+
+// TagCount - A tag and how many live (untrashed) nodes carry it
+type TagCount struct {
+    ID    uint   `json:"id"`
+    Name  string `json:"name"`
+    Count int64  `json:"count"`
+}
+
+// normalizeTag lower-cases a tag name and collapses its whitespace; commas are
+// reserved as the FileNode.Tags separator
+func normalizeTag(name string) (string, error) {
+    name = strings.ToLower(strings.Join(strings.Fields(name), " "))
+    if name == "" || utf8.RuneCountInString(name) > maxTagLength || strings.Contains(name, ",") {
+        return "", ErrInvalidTag
+    }
+    return name, nil
+}
+
+// normalizeTags normalizes and de-duplicates tag names
+func normalizeTags(names []string) ([]string, error) {
+    seen := make(map[string]bool, len(names))
+    normalized := make([]string, 0, len(names))
+    for _, name := range names {
+        tag, err := normalizeTag(name)
+        if err != nil {
+            return nil, err
+        }
+        if !seen[tag] {
+            seen[tag] = true
+            normalized = append(normalized, tag)
+        }
+    }
+    return normalized, nil
+}
+
+// splitTags parses a comma-separated tag list, dropping names that aren't valid tags
+func splitTags(list string) []string {
+    var names []string
+    for _, name := range strings.Split(list, ",") {
+        if tag, err := normalizeTag(name); err == nil {
+            names = append(names, tag)
+        }
+    }
+    return names
+}
+
+// TagNodes - Adds tags to nodes, creating the user's tags as needed
+func (fs *FileSystem) TagNodes(nodeIDs []uint, names []string, userID uint) ([]Tag, error) {
+    names, err := normalizeTags(names)
+    if err != nil {
+        return nil, err
+    }
+
+    var tags []Tag
+    err = fs.DB.Transaction(func(tx *gorm.DB) error {
+        var err error
+        tags, err = fs.withTx(tx).tagNodes(nodeIDs, names, userID)
+        return err
+    })
+    return tags, err
+}
+
+// tagNodes links already normalized tag names to nodes
+func (fs *FileSystem) tagNodes(nodeIDs []uint, names []string, userID uint) ([]Tag, error) {
+    if len(names) == 0 {
+        return nil, fs.syncFileTags(nodeIDs)
+    }
+
+    for _, name := range names {
+        if err := fs.DB.Clauses(clause.OnConflict{DoNothing: true}).Create(&Tag{OwnerID: userID, Name: name}).Error; err != nil {
+            return nil, err
+        }
+    }
+    var tags []Tag
+    if err := fs.DB.Where("owner_id = ? AND name IN ?", userID, names).Order("name").Find(&tags).Error; err != nil {
+        return nil, err
+    }
+
+    links := make([]NodeTag, 0, len(nodeIDs)*len(tags))
+    for _, nodeID := range nodeIDs {
+        for _, tag := range tags {
+            links = append(links, NodeTag{TrieNodeID: nodeID, TagID: tag.ID})
+        }
+    }
+    if len(links) > 0 {
+        if err := fs.DB.Clauses(clause.OnConflict{DoNothing: true}).CreateInBatches(links, 500).Error; err != nil {
+            return nil, err
+        }
+    }
+
+    return tags, fs.syncFileTags(nodeIDs)
+}
+
+// UntagNodes - Removes tags from nodes. Returns how many links were removed;
+// the tags themselves are kept for autocomplete until deleted.
+func (fs *FileSystem) UntagNodes(nodeIDs []uint, names []string, userID uint) (int64, error) {
+    names, err := normalizeTags(names)
+    if err != nil {
+        return 0, err
+    }
+    if len(names) == 0 || len(nodeIDs) == 0 {
+        return 0, nil
+    }
+
+    var removed int64
+    err = fs.DB.Transaction(func(tx *gorm.DB) error {
+        result := tx.Where("trie_node_id IN ? AND tag_id IN (SELECT id FROM tags WHERE owner_id = ? AND name IN ?)",
+            nodeIDs, userID, names).Delete(&NodeTag{})
+        if result.Error != nil {
+            return result.Error
+        }
+        removed = result.RowsAffected
+        return fs.withTx(tx).syncFileTags(nodeIDs)
+    })
+    return removed, err
+}
+
+// RenameTag - Renames one of the user's tags; renaming onto an existing tag merges the two
+func (fs *FileSystem) RenameTag(tagID uint, name string, userID uint) (*Tag, error) {
+    name, err := normalizeTag(name)
+    if err != nil {
+        return nil, err
+    }
+
+    var tag Tag
+    err = fs.DB.Transaction(func(tx *gorm.DB) error {
+        if err := tx.Where("id = ? AND owner_id = ?", tagID, userID).First(&tag).Error; err != nil {
+            return ErrTagNotFound
+        }
+        if tag.Name == name {
+            return nil
+        }
+
+        var nodeIDs []uint
+        if err := tx.Model(&NodeTag{}).Where("tag_id = ?", tag.ID).Pluck("trie_node_id", &nodeIDs).Error; err != nil {
+            return err
+        }
+
+        var existing Tag
+        if err := tx.Where("owner_id = ? AND name = ?", userID, name).First(&existing).Error; err != nil {
+            tag.Name = name
+            if err := tx.Model(&tag).Update("name", name).Error; err != nil {
+                return err
+            }
+            return fs.withTx(tx).syncFileTags(nodeIDs)
+        }
+
+        err := tx.Exec(`INSERT INTO node_tags (trie_node_id, tag_id, created_at)
+            SELECT trie_node_id, ?, created_at FROM node_tags WHERE tag_id = ?
+            ON CONFLICT DO NOTHING`, existing.ID, tag.ID).Error
+        if err != nil {
+            return err
+        }
+        if err := tx.Where("tag_id = ?", tag.ID).Delete(&NodeTag{}).Error; err != nil {
+            return err
+        }
+        if err := tx.Delete(&tag).Error; err != nil {
+            return err
+        }
+        tag = existing
+        return fs.withTx(tx).syncFileTags(nodeIDs)
+    })
+    if err != nil {
+        return nil, err
+    }
+    return &tag, nil
+}
+
+// DeleteTag - Deletes one of the user's tags and removes it from every node
+func (fs *FileSystem) DeleteTag(tagID uint, userID uint) error {
+    return fs.DB.Transaction(func(tx *gorm.DB) error {
+        var tag Tag
+        if err := tx.Where("id = ? AND owner_id = ?", tagID, userID).First(&tag).Error; err != nil {
+            return ErrTagNotFound
+        }
+
+        var nodeIDs []uint
+        if err := tx.Model(&NodeTag{}).Where("tag_id = ?", tag.ID).Pluck("trie_node_id", &nodeIDs).Error; err != nil {
+            return err
+        }
+        if err := tx.Where("tag_id = ?", tag.ID).Delete(&NodeTag{}).Error; err != nil {
+            return err
+        }
+        if err := tx.Delete(&tag).Error; err != nil {
+            return err
+        }
+        return fs.withTx(tx).syncFileTags(nodeIDs)
+    })
+}
+
+// SuggestTags - The user's tags starting with prefix, most used first
+func (fs *FileSystem) SuggestTags(prefix string, userID uint, limit int) ([]TagCount, error) {
+    prefix = strings.ToLower(strings.Join(strings.Fields(prefix), " "))
+
+    var counts []TagCount
+    err := fs.DB.Raw(`SELECT tags.id, tags.name, COUNT(trie_nodes.id) AS count
+        FROM tags
+        LEFT JOIN node_tags ON node_tags.tag_id = tags.id
+        LEFT JOIN trie_nodes ON trie_nodes.id = node_tags.trie_node_id AND trie_nodes.trashed = ?
+        WHERE tags.owner_id = ? AND LEFT(tags.name, ?) = ?
+        GROUP BY tags.id, tags.name
+        ORDER BY count DESC, tags.name
+        LIMIT ?`,
+        false, userID, utf8.RuneCountInString(prefix), prefix, limit).Scan(&counts).Error
+    return counts, err
+}
+
+// nodeTagNames returns each node's tag names, sorted and comma-joined as in FileNode.Tags
+func (fs *FileSystem) nodeTagNames(nodeIDs []uint) (map[uint]string, error) {
+    var rows []struct {
+        TrieNodeID uint
+        Name       string
+    }
+    err := fs.DB.Table("node_tags").Select("node_tags.trie_node_id, tags.name").
+        Joins("JOIN tags ON tags.id = node_tags.tag_id").
+        Where("node_tags.trie_node_id IN ?", nodeIDs).Scan(&rows).Error
+    if err != nil {
+        return nil, err
+    }
+
+    names := make(map[uint][]string)
+    for _, row := range rows {
+        names[row.TrieNodeID] = append(names[row.TrieNodeID], row.Name)
+    }
+    joined := make(map[uint]string, len(names))
+    for nodeID, list := range names {
+        sort.Strings(list)
+        joined[nodeID] = strings.Join(list, ",")
+    }
+    return joined, nil
+}
+
+// copyNodeTags gives each copied node (new id) the tags of its source (old id)
+func (fs *FileSystem) copyNodeTags(newIDs map[uint]uint) error {
+    oldIDs := make([]uint, 0, len(newIDs))
+    for oldID := range newIDs {
+        oldIDs = append(oldIDs, oldID)
+    }
+
+    var links []NodeTag
+    if err := fs.DB.Where("trie_node_id IN ?", oldIDs).Find(&links).Error; err != nil {
+        return err
+    }
+    if len(links) == 0 {
+        return nil
+    }
+
+    copies := make([]NodeTag, 0, len(links))
+    for _, link := range links {
+        copies = append(copies, NodeTag{TrieNodeID: newIDs[link.TrieNodeID], TagID: link.TagID})
+    }
+    return fs.DB.CreateInBatches(copies, 500).Error
+}
+
+// syncFileTags rewrites FileNode.Tags for the files among nodeIDs from their NodeTags
+func (fs *FileSystem) syncFileTags(nodeIDs []uint) error {
+    if len(nodeIDs) == 0 {
+        return nil
+    }
+    return fs.DB.Exec(`UPDATE file_nodes SET tags = COALESCE((
+            SELECT string_agg(tags.name, ',' ORDER BY tags.name)
+            FROM node_tags JOIN tags ON tags.id = node_tags.tag_id
+            WHERE node_tags.trie_node_id = file_nodes.trie_node_id), '')
+        WHERE trie_node_id IN ?`, nodeIDs).Error
+}
+
+// migrateLegacyTags moves free-form FileNode.Tags strings written before the tag
+// tables existed into Tags and NodeTags; names that aren't valid tags are dropped
+func migrateLegacyTags(db *gorm.DB) error {
+    var rows []struct {
+        TrieNodeID uint
+        OwnerID    uint
+        Tags       string
+    }
+    err := db.Table("file_nodes").Select("file_nodes.trie_node_id, trie_nodes.owner_id, file_nodes.tags").
+        Joins("JOIN trie_nodes ON trie_nodes.id = file_nodes.trie_node_id").
+        Where("file_nodes.tags <> '' AND NOT EXISTS (SELECT 1 FROM node_tags WHERE node_tags.trie_node_id = file_nodes.trie_node_id)").
+        Scan(&rows).Error
+    if err != nil {
+        return err
+    }
+
+    fs := &FileSystem{DB: db}
+    for _, row := range rows {
+        if _, err := fs.TagNodes([]uint{row.TrieNodeID}, splitTags(row.Tags), row.OwnerID); err != nil {
+            return err
+        }
+    }
+
+    if len(rows) > 0 {
+        log.Printf("Migrated tags of %d files", len(rows))
+    }
+    return nil
+}
+
+// Tag handlers
+
+// tagRequest names nodes by path and/or file id, for single and bulk tagging
+type tagRequest struct {
+    Paths   []string `json:"paths"`
+    FileIDs []uint   `json:"file_ids"`
+    Tags    []string `json:"tags"`
+}
+
+// ListTags handles GET /api/tags?prefix=...&limit=N for autocomplete
+func (app *App) ListTags(w http.ResponseWriter, r *http.Request) {
+    userID := app.getUserID(r)
+
+    limit := defaultTagSuggest
+    if value := r.URL.Query().Get("limit"); value != "" {
+        n, err := strconv.Atoi(value)
+        if err != nil || n < 1 {
+            http.Error(w, "Invalid limit", http.StatusBadRequest)
+            return
+        }
+        if n > maxTagSuggest {
+            n = maxTagSuggest
+        }
+        limit = n
+    }
+
+    fs := NewFileSystem(app.DB, app.Blobs, app.Keys, userID)
+    counts, err := fs.SuggestTags(r.URL.Query().Get("prefix"), userID, limit)
+    if err != nil {
+        http.Error(w, "Failed to list tags", http.StatusInternalServerError)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(counts)
+}
+
+func (app *App) AddTags(w http.ResponseWriter, r *http.Request) {
+    userID := app.getUserID(r)
+
+    fs, nodeIDs, req, ok := app.tagTargets(w, r, userID)
+    if !ok {
+        return
+    }
+
+    tags, err := fs.TagNodes(nodeIDs, req.Tags, userID)
+    if err == ErrInvalidTag {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "message": "Tags added",
+        "nodes":   len(nodeIDs),
+        "tags":    tags,
+    })
+}
+
+func (app *App) RemoveTags(w http.ResponseWriter, r *http.Request) {
+    userID := app.getUserID(r)
+
+    fs, nodeIDs, req, ok := app.tagTargets(w, r, userID)
+    if !ok {
+        return
+    }
+
+    removed, err := fs.UntagNodes(nodeIDs, req.Tags, userID)
+    if err == ErrInvalidTag {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "message": "Tags removed",
+        "nodes":   len(nodeIDs),
+        "removed": removed,
+    })
+}
+
+func (app *App) RenameTag(w http.ResponseWriter, r *http.Request) {
+    userID := app.getUserID(r)
+    tagID, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+    var req struct {
+        Name string `json:"name"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        http.Error(w, "Invalid request", http.StatusBadRequest)
+        return
+    }
+
+    fs := NewFileSystem(app.DB, app.Blobs, app.Keys, userID)
+    tag, err := fs.RenameTag(uint(tagID), req.Name, userID)
+    switch {
+    case err == ErrInvalidTag:
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    case err == ErrTagNotFound:
+        http.Error(w, "Tag not found", http.StatusNotFound)
+        return
+    case err != nil:
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(tag)
+}
+
+func (app *App) DeleteTag(w http.ResponseWriter, r *http.Request) {
+    userID := app.getUserID(r)
+    tagID, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+    fs := NewFileSystem(app.DB, app.Blobs, app.Keys, userID)
+    err := fs.DeleteTag(uint(tagID), userID)
+    if err == ErrTagNotFound {
+        http.Error(w, "Tag not found", http.StatusNotFound)
+        return
+    }
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]string{"message": "Tag deleted"})
+}
+
+// tagTargets decodes a tagRequest and resolves its paths and file ids to the
+// user's own trie nodes; symlinks are tagged themselves, not their targets
+func (app *App) tagTargets(w http.ResponseWriter, r *http.Request, userID uint) (*FileSystem, []uint, tagRequest, bool) {
+    var req tagRequest
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        http.Error(w, "Invalid request", http.StatusBadRequest)
+        return nil, nil, req, false
+    }
+    if len(req.Tags) == 0 || len(req.Paths)+len(req.FileIDs) == 0 {
+        http.Error(w, "tags and paths or file_ids are required", http.StatusBadRequest)
+        return nil, nil, req, false
+    }
+
+    fs := NewFileSystem(app.DB, app.Blobs, app.Keys, userID)
+    seen := make(map[uint]bool)
+    var nodeIDs []uint
+    for _, nodePath := range req.Paths {
+        parts := fs.SplitPath(nodePath)
+        if parts == nil {
+            http.Error(w, "Invalid path: "+nodePath, http.StatusBadRequest)
+            return nil, nil, req, false
+        }
+        node, err := fs.Search(joinPath(parts), userID)
+        if err != nil || node.Trashed {
+            http.Error(w, "Path not found: "+nodePath, http.StatusNotFound)
+            return nil, nil, req, false
+        }
+        if !seen[node.ID] {
+            seen[node.ID] = true
+            nodeIDs = append(nodeIDs, node.ID)
+        }
+    }
+
+    if len(req.FileIDs) > 0 {
+        var fileNodeIDs []uint
+        err := app.DB.Table("file_nodes").
+            Joins("JOIN trie_nodes ON trie_nodes.id = file_nodes.trie_node_id").
+            Where("file_nodes.id IN ? AND trie_nodes.owner_id = ? AND trie_nodes.trashed = ?", req.FileIDs, userID, false).
+            Pluck("file_nodes.trie_node_id", &fileNodeIDs).Error
+        if err != nil {
+            http.Error(w, err.Error(), http.StatusInternalServerError)
+            return nil, nil, req, false
+        }
+        if len(fileNodeIDs) != len(uniqueIDs(req.FileIDs)) {
+            http.Error(w, "File not found", http.StatusNotFound)
+            return nil, nil, req, false
+        }
+        for _, nodeID := range fileNodeIDs {
+            if !seen[nodeID] {
+                seen[nodeID] = true
+                nodeIDs = append(nodeIDs, nodeID)
+            }
+        }
+    }
+
+    return fs, nodeIDs, req, true
+}
+
+func uniqueIDs(ids []uint) map[uint]bool {
+    unique := make(map[uint]bool, len(ids))
+    for _, id := range ids {
+        unique[id] = true
+    }
+    return unique
+}
@@ -0,0 +1,467 @@
+package internal
+
+import (
+    "crypto/hmac"
+    "crypto/rand"
+    "crypto/sha1"
+    "encoding/base32"
+    "encoding/binary"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "log"
+    "net/http"
+    "net/url"
+    "strings"
+    "time"
+
+    "github.com/golang-jwt/jwt/v5"
+    "gorm.io/gorm"
+
+    "file-vault/pkg"
+)
+
+// Two-factor authentication with RFC 6238 TOTP codes (SHA-1, 6 digits, 30s steps, the
+// defaults every authenticator app supports). With 2FA enabled, a correct password
+// only yields a short-lived challenge token; a code turns it into a session.
+const (
+    totpIssuer        = "FileVault"
+    totpPeriod        = 30
+    totpDigits        = 6
+    totpSkew          = 1 // Steps of clock drift accepted either way
+    recoveryCodeCount = 10
+
+    challengeTTL = 5 * time.Minute
+
+    // Wrong codes are limited per user, since anyone with the password can get new
+    // challenges: after maxTOTPFailures in a row the account's second factor locks for
+    // totpLockout, doubling with each further failure
+    maxTOTPFailures    = 5
+    totpLockout        = time.Minute
+    maxTOTPLockoutStep = 10 // Longest lockout is totpLockout << 10, about 17 hours
+
+    settingRequireAdmin2FA = "require_admin_2fa"
+)
+
+var ErrInvalidTOTPCode = errors.New("invalid two-factor code")
+var ErrTwoFactorRequired = errors.New("two-factor authentication is required for admins")
+var ErrTwoFactorLocked = errors.New("too many wrong two-factor codes, try again later")
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// newTOTPSecret returns a random 160-bit secret, base32 encoded for authenticator apps
+func newTOTPSecret() string {
+    secret := make([]byte, 20)
+    rand.Read(secret)
+    return totpEncoding.EncodeToString(secret)
+}
+
+// totpCode computes the code for one time step
+func totpCode(secret string, step int64) (string, error) {
+    key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+    if err != nil {
+        return "", err
+    }
+
+    var counter [8]byte
+    binary.BigEndian.PutUint64(counter[:], uint64(step))
+    mac := hmac.New(sha1.New, key)
+    mac.Write(counter[:])
+    sum := mac.Sum(nil)
+
+    // Dynamic truncation (RFC 4226 section 5.3)
+    offset := sum[len(sum)-1] & 0x0f
+    value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+    return fmt.Sprintf("%0*d", totpDigits, value%1000000), nil
+}
+
+// matchTOTP returns the time step code is valid for, allowing for clock skew
+func matchTOTP(secret, code string, now time.Time) (int64, bool) {
+    code = strings.ReplaceAll(code, " ", "")
+    if len(code) != totpDigits {
+        return 0, false
+    }
+    current := now.Unix() / totpPeriod
+    for step := current - totpSkew; step <= current+totpSkew; step++ {
+        expected, err := totpCode(secret, step)
+        if err == nil && hmac.Equal([]byte(expected), []byte(code)) {
+            return step, true
+        }
+    }
+    return 0, false
+}
+
+// totpURI builds the otpauth:// URI authenticator apps scan as a QR code
+func totpURI(user *User, secret string) string {
+    label := url.PathEscape(totpIssuer + ":" + user.Email)
+    params := url.Values{
+        "secret":    {secret},
+        "issuer":    {totpIssuer},
+        "algorithm": {"SHA1"},
+        "digits":    {fmt.Sprint(totpDigits)},
+        "period":    {fmt.Sprint(totpPeriod)},
+    }
+    return "otpauth://totp/" + label + "?" + params.Encode()
+}
+
+// verifySecondFactor checks a TOTP code, or else a single-use recovery code, unless wrong
+// codes have locked the user's second factor. A TOTP code is rejected if its step was
+// already used, so a seen code can't be replayed.
+func (app *App) verifySecondFactor(user *User, code, recoveryCode string) error {
+    var locked int64
+    app.DB.Model(&User{}).Where("id = ? AND totp_locked_until > ?", user.ID, time.Now()).Count(&locked)
+    if locked > 0 {
+        return ErrTwoFactorLocked
+    }
+
+    if err := app.checkSecondFactor(user, code, recoveryCode); err != nil {
+        app.recordTOTPFailure(user.ID)
+        return err
+    }
+    app.DB.Model(&User{}).Where("id = ? AND totp_failures > 0", user.ID).
+        Updates(map[string]interface{}{"totp_failures": 0, "totp_locked_until": nil})
+    return nil
+}
+
+func (app *App) checkSecondFactor(user *User, code, recoveryCode string) error {
+    if recoveryCode != "" {
+        normalized := strings.ToLower(strings.ReplaceAll(recoveryCode, "-", ""))
+        result := app.DB.Model(&RecoveryCode{}).
+            Where("user_id = ? AND code_hash = ? AND used_at IS NULL", user.ID, utils.CalculateHash([]byte(normalized))).
+            Update("used_at", time.Now())
+        if result.Error != nil || result.RowsAffected == 0 {
+            return ErrInvalidTOTPCode
+        }
+        return nil
+    }
+
+    step, ok := matchTOTP(user.TOTPSecret, code, time.Now())
+    if !ok {
+        return ErrInvalidTOTPCode
+    }
+    result := app.DB.Model(&User{}).Where("id = ? AND totp_last_step < ?", user.ID, step).Update("totp_last_step", step)
+    if result.Error != nil || result.RowsAffected == 0 {
+        return ErrInvalidTOTPCode
+    }
+    user.TOTPLastStep = step
+    return nil
+}
+
+// recordTOTPFailure counts a wrong code in one statement, so concurrent guesses all count,
+// and locks the second factor once failures reach maxTOTPFailures
+func (app *App) recordTOTPFailure(userID uint) {
+    err := app.DB.Exec(`UPDATE users SET totp_failures = totp_failures + 1,
+        totp_locked_until = CASE WHEN totp_failures + 1 >= ?
+            THEN NOW() + ? * POWER(2, LEAST(totp_failures + 1 - ?, ?)) * INTERVAL '1 second'
+            ELSE totp_locked_until END
+        WHERE id = ?`,
+        maxTOTPFailures, totpLockout.Seconds(), maxTOTPFailures, maxTOTPLockoutStep, userID).Error
+    if err != nil {
+        log.Printf("Failed to record two-factor failure for user %d: %v", userID, err)
+    }
+}
+
+// secondFactorStatus is the HTTP status for a verifySecondFactor error
+func secondFactorStatus(err error, status int) int {
+    if err == ErrTwoFactorLocked {
+        return http.StatusTooManyRequests
+    }
+    return status
+}
+
+// generateRecoveryCodes replaces a user's recovery codes and returns the new ones
+func generateRecoveryCodes(tx *gorm.DB, userID uint) ([]string, error) {
+    if err := tx.Where("user_id = ?", userID).Delete(&RecoveryCode{}).Error; err != nil {
+        return nil, err
+    }
+
+    codes := make([]string, 0, recoveryCodeCount)
+    rows := make([]RecoveryCode, 0, recoveryCodeCount)
+    for i := 0; i < recoveryCodeCount; i++ {
+        raw := utils.GenerateToken()[:10]
+        codes = append(codes, raw[:5]+"-"+raw[5:])
+        rows = append(rows, RecoveryCode{UserID: userID, CodeHash: utils.CalculateHash([]byte(raw))})
+    }
+    return codes, tx.Create(&rows).Error
+}
+
+// issueChallenge signs the token a password login returns when 2FA is enabled
+func (app *App) issueChallenge(userID uint) (string, error) {
+    token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+        "user_id": userID,
+        "jti":     utils.GenerateToken(),
+        "typ":     "2fa",
+        "exp":     time.Now().Add(challengeTTL).Unix(),
+    })
+    return token.SignedString([]byte(app.JWTSecret))
+}
+
+// parseChallenge validates a challenge token and returns its user id and jti
+func (app *App) parseChallenge(tokenString string) (uint, string, error) {
+    token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+        return []byte(app.JWTSecret), nil
+    }, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
+    if err != nil || !token.Valid {
+        return 0, "", errors.New("invalid or expired challenge")
+    }
+
+    claims, _ := token.Claims.(jwt.MapClaims)
+    userID, ok := claims["user_id"].(float64)
+    jti, _ := claims["jti"].(string)
+    if typ, _ := claims["typ"].(string); !ok || typ != "2fa" || jti == "" || app.isTokenRevoked(jti) {
+        return 0, "", errors.New("invalid or expired challenge")
+    }
+    return uint(userID), jti, nil
+}
+
+// endChallenge makes a successfully answered challenge single-use
+func (app *App) endChallenge(jti string, userID uint) {
+    app.revokeAccessToken(jti, userID, time.Now().Add(challengeTTL))
+}
+
+// adminTwoFactorRequired reports whether admins must have 2FA enabled
+func (app *App) adminTwoFactorRequired() bool {
+    var setting Setting
+    return app.DB.Where("key = ?", settingRequireAdmin2FA).First(&setting).Error == nil && setting.Value == "true"
+}
+
+// RequireTwoFactor blocks admins without 2FA from admin routes while the policy is on.
+// They can still log in, so they can enroll.
+func (app *App) RequireTwoFactor(next http.HandlerFunc) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        var user User
+        if app.DB.First(&user, app.getUserID(r)).Error == nil && user.Role == "admin" && !user.TOTPEnabled && app.adminTwoFactorRequired() {
+            http.Error(w, "Two-factor authentication is required for admins; enroll at /api/2fa/enroll", http.StatusForbidden)
+            return
+        }
+        next(w, r)
+    }
+}
+
+// Two-factor handlers
+
+// CompleteLogin exchanges a login challenge and a TOTP or recovery code for a session
+func (app *App) CompleteLogin(w http.ResponseWriter, r *http.Request) {
+    var req struct {
+        ChallengeToken string `json:"challenge_token"`
+        Code           string `json:"code"`
+        RecoveryCode   string `json:"recovery_code"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ChallengeToken == "" {
+        http.Error(w, "challenge_token is required", http.StatusBadRequest)
+        return
+    }
+
+    userID, jti, err := app.parseChallenge(req.ChallengeToken)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusUnauthorized)
+        return
+    }
+
+    var user User
+    if err := app.DB.First(&user, userID).Error; err != nil || !user.TOTPEnabled {
+        http.Error(w, "invalid or expired challenge", http.StatusUnauthorized)
+        return
+    }
+    if err := app.verifySecondFactor(&user, req.Code, req.RecoveryCode); err != nil {
+        http.Error(w, err.Error(), secondFactorStatus(err, http.StatusUnauthorized))
+        return
+    }
+
+    app.endChallenge(jti, userID)
+    app.writeSession(w, r, &user)
+}
+
+// EnrollTwoFactor starts enrollment with a new secret; 2FA stays off until verified
+func (app *App) EnrollTwoFactor(w http.ResponseWriter, r *http.Request) {
+    var user User
+    if err := app.DB.First(&user, app.getUserID(r)).Error; err != nil {
+        http.Error(w, "User not found", http.StatusNotFound)
+        return
+    }
+    if user.TOTPEnabled {
+        http.Error(w, "Two-factor authentication is already enabled", http.StatusConflict)
+        return
+    }
+
+    secret := newTOTPSecret()
+    if err := app.DB.Model(&user).Updates(map[string]interface{}{"totp_secret": secret, "totp_last_step": 0}).Error; err != nil {
+        http.Error(w, "Failed to start enrollment", http.StatusInternalServerError)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]string{
+        "secret":      secret,
+        "otpauth_uri": totpURI(&user, secret),
+    })
+}
+
+// VerifyTwoFactor enables 2FA once the user proves their app produces valid codes
+func (app *App) VerifyTwoFactor(w http.ResponseWriter, r *http.Request) {
+    var req struct {
+        Code string `json:"code"`
+    }
+    json.NewDecoder(r.Body).Decode(&req)
+
+    var user User
+    if err := app.DB.First(&user, app.getUserID(r)).Error; err != nil {
+        http.Error(w, "User not found", http.StatusNotFound)
+        return
+    }
+    if user.TOTPEnabled {
+        http.Error(w, "Two-factor authentication is already enabled", http.StatusConflict)
+        return
+    }
+    if user.TOTPSecret == "" {
+        http.Error(w, "Start enrollment first", http.StatusBadRequest)
+        return
+    }
+    if err := app.verifySecondFactor(&user, req.Code, ""); err != nil {
+        http.Error(w, err.Error(), secondFactorStatus(err, http.StatusBadRequest))
+        return
+    }
+
+    var codes []string
+    err := app.DB.Transaction(func(tx *gorm.DB) error {
+        if err := tx.Model(&user).Update("totp_enabled", true).Error; err != nil {
+            return err
+        }
+        var err error
+        codes, err = generateRecoveryCodes(tx, user.ID)
+        return err
+    })
+    if err != nil {
+        http.Error(w, "Failed to enable two-factor authentication", http.StatusInternalServerError)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "message":        "Two-factor authentication enabled",
+        "recovery_codes": codes,
+    })
+}
+
+// DisableTwoFactor turns 2FA off; it takes a current code or a recovery code
+func (app *App) DisableTwoFactor(w http.ResponseWriter, r *http.Request) {
+    var req struct {
+        Code         string `json:"code"`
+        RecoveryCode string `json:"recovery_code"`
+    }
+    json.NewDecoder(r.Body).Decode(&req)
+
+    var user User
+    if err := app.DB.First(&user, app.getUserID(r)).Error; err != nil {
+        http.Error(w, "User not found", http.StatusNotFound)
+        return
+    }
+    if !user.TOTPEnabled {
+        http.Error(w, "Two-factor authentication is not enabled", http.StatusBadRequest)
+        return
+    }
+    if user.Role == "admin" && app.adminTwoFactorRequired() {
+        http.Error(w, ErrTwoFactorRequired.Error(), http.StatusForbidden)
+        return
+    }
+    if err := app.verifySecondFactor(&user, req.Code, req.RecoveryCode); err != nil {
+        http.Error(w, err.Error(), secondFactorStatus(err, http.StatusBadRequest))
+        return
+    }
+
+    err := app.DB.Transaction(func(tx *gorm.DB) error {
+        err := tx.Model(&user).Updates(map[string]interface{}{
+            "totp_enabled":   false,
+            "totp_secret":    "",
+            "totp_last_step": 0,
+        }).Error
+        if err != nil {
+            return err
+        }
+        return tx.Where("user_id = ?", user.ID).Delete(&RecoveryCode{}).Error
+    })
+    if err != nil {
+        http.Error(w, "Failed to disable two-factor authentication", http.StatusInternalServerError)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]string{"message": "Two-factor authentication disabled"})
+}
+
+// RegenerateRecoveryCodes replaces the recovery codes; it takes a current code
+func (app *App) RegenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+    var req struct {
+        Code string `json:"code"`
+    }
+    json.NewDecoder(r.Body).Decode(&req)
+
+    var user User
+    if err := app.DB.First(&user, app.getUserID(r)).Error; err != nil {
+        http.Error(w, "User not found", http.StatusNotFound)
+        return
+    }
+    if !user.TOTPEnabled {
+        http.Error(w, "Two-factor authentication is not enabled", http.StatusBadRequest)
+        return
+    }
+    if err := app.verifySecondFactor(&user, req.Code, ""); err != nil {
+        http.Error(w, err.Error(), secondFactorStatus(err, http.StatusBadRequest))
+        return
+    }
+
+    var codes []string
+    err := app.DB.Transaction(func(tx *gorm.DB) error {
+        var err error
+        codes, err = generateRecoveryCodes(tx, user.ID)
+        return err
+    })
+    if err != nil {
+        http.Error(w, "Failed to generate recovery codes", http.StatusInternalServerError)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{"recovery_codes": codes})
+}
+
+// UpdateSecuritySettings lets an admin require 2FA for the admin role
+func (app *App) UpdateSecuritySettings(w http.ResponseWriter, r *http.Request) {
+    var currentUser User
+    if app.DB.First(&currentUser, app.getUserID(r)).Error != nil || currentUser.Role != "admin" {
+        http.Error(w, "Access denied", http.StatusForbidden)
+        return
+    }
+
+    var req struct {
+        RequireAdmin2FA bool `json:"require_admin_2fa"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        http.Error(w, "Invalid request", http.StatusBadRequest)
+        return
+    }
+    // Don't let an admin lock themselves out of the admin routes
+    if req.RequireAdmin2FA && !currentUser.TOTPEnabled {
+        http.Error(w, "Enable two-factor authentication on your own account first", http.StatusConflict)
+        return
+    }
+
+    setting := Setting{Key: settingRequireAdmin2FA, Value: fmt.Sprint(req.RequireAdmin2FA)}
+    if err := app.DB.Save(&setting).Error; err != nil {
+        http.Error(w, "Failed to save settings", http.StatusInternalServerError)
+        return
+    }
+
+    app.GetSecuritySettings(w, r)
+}
+
+func (app *App) GetSecuritySettings(w http.ResponseWriter, r *http.Request) {
+    var currentUser User
+    if app.DB.First(&currentUser, app.getUserID(r)).Error != nil || currentUser.Role != "admin" {
+        http.Error(w, "Access denied", http.StatusForbidden)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]bool{"require_admin_2fa": app.adminTwoFactorRequired()})
+}
@@ -0,0 +1,73 @@
+package internal
+
+import (
+    "encoding/base32"
+    "testing"
+    "time"
+)
+
+// RFC 6238 appendix B, SHA-1 with the ASCII seed "12345678901234567890". The RFC lists
+// 8-digit codes; 6-digit codes are their last six digits.
+var rfc6238Secret = base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString([]byte("12345678901234567890"))
+
+func TestTOTPCodeRFC6238(t *testing.T) {
+    tests := []struct {
+        unix int64
+        want string
+    }{
+        {59, "287082"},
+        {1111111109, "081804"},
+        {1111111111, "050471"},
+        {1234567890, "005924"},
+        {2000000000, "279037"},
+        {20000000000, "353130"},
+    }
+    for _, tt := range tests {
+        got, err := totpCode(rfc6238Secret, tt.unix/totpPeriod)
+        if err != nil {
+            t.Fatal(err)
+        }
+        if got != tt.want {
+            t.Errorf("totpCode at %d = %s, want %s", tt.unix, got, tt.want)
+        }
+    }
+}
+
+func TestTOTPCodeInvalidSecret(t *testing.T) {
+    if _, err := totpCode("not base32!", 1); err == nil {
+        t.Error("totpCode accepted an invalid secret")
+    }
+}
+
+func TestMatchTOTP(t *testing.T) {
+    now := time.Unix(1111111111, 0)
+    step := now.Unix() / totpPeriod
+    code := func(s int64) string {
+        c, _ := totpCode(rfc6238Secret, s)
+        return c
+    }
+
+    tests := []struct {
+        name     string
+        code     string
+        wantStep int64
+        ok       bool
+    }{
+        {"current step", code(step), step, true},
+        {"previous step within skew", code(step - 1), step - 1, true},
+        {"next step within skew", code(step + 1), step + 1, true},
+        {"spaces ignored", code(step)[:3] + " " + code(step)[3:], step, true},
+        {"two steps old", code(step - 2), 0, false},
+        {"wrong code", "000000", 0, false},
+        {"too short", code(step)[:5], 0, false},
+        {"empty", "", 0, false},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            gotStep, ok := matchTOTP(rfc6238Secret, tt.code, now)
+            if ok != tt.ok || (ok && gotStep != tt.wantStep) {
+                t.Errorf("matchTOTP(%q) = %d, %v; want %d, %v", tt.code, gotStep, ok, tt.wantStep, tt.ok)
+            }
+        })
+    }
+}
@@ -0,0 +1,307 @@
+package internal
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "log"
+    "net/http"
+    "os"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/gorilla/mux"
+    "gorm.io/gorm"
+)
+
+// Trashed subtrees are re-rooted under a path no SplitPath-validated input can
+// produce (it contains ".."), so Search, Insert and subtree queries never see them
+const trashPathPrefix = "/../trash/"
+
+const defaultTrashRetention = 30 * 24 * time.Hour
+
+var ErrRestoreConflict = errors.New("a node already exists at the restore path")
+
+// Trash - Moves a file, link or directory into the owner's trash; quota is only released on purge
+func (fs *FileSystem) Trash(filePath string, recursive bool, userID uint) (*TrashEntry, error) {
+    pathParts := fs.SplitPath(filePath)
+    if pathParts == nil {
+        return nil, errors.New("invalid path")
+    }
+    if len(pathParts) == 0 {
+        return nil, errors.New("cannot delete the root directory")
+    }
+    filePath = joinPath(pathParts)
+
+    var entry *TrashEntry
+    err := fs.DB.Transaction(func(tx *gorm.DB) error {
+        node, err := fs.withTx(tx).Search(filePath, userID)
+        if err != nil {
+            return errors.New("path not found")
+        }
+
+        if node.NodeType == "directory" && !recursive {
+            var children int64
+            tx.Model(&TrieNode{}).Where("parent_id = ?", node.ID).Count(&children)
+            if children > 0 {
+                return ErrDirectoryNotEmpty
+            }
+        }
+
+        var size int64
+        tx.Model(&FileNode{}).
+            Where("trie_node_id IN (SELECT id FROM trie_nodes WHERE owner_id = ? AND (id = ? OR starts_with(path, ?)))",
+                userID, node.ID, filePath+"/").
+            Select("COALESCE(SUM(size), 0)").Scan(&size)
+
+        entry = &TrashEntry{
+            OwnerID:      userID,
+            TrieNodeID:   node.ID,
+            OriginalPath: filePath,
+            NodeType:     node.NodeType,
+            Size:         size,
+            TrashedAt:    time.Now(),
+        }
+        if err := tx.Create(entry).Error; err != nil {
+            return err
+        }
+
+        trashPath := fmt.Sprintf("%s%d/%s", trashPathPrefix, entry.ID, node.Name)
+        if err := rebaseSubtree(tx, userID, filePath, trashPath, true); err != nil {
+            return err
+        }
+
+        // Detach from the live tree so the name is free for new uploads
+        return tx.Model(node).Updates(map[string]interface{}{
+            "path":      trashPath,
+            "parent_id": nil,
+            "trashed":   true,
+        }).Error
+    })
+
+    return entry, err
+}
+
+// RestoreFromTrash - Puts a trashed subtree back at its original path (or destPath).
+// onConflict is "fail" (default), "rename" to pick a free name, or "replace" to trash
+// whatever currently occupies the path.
+func (fs *FileSystem) RestoreFromTrash(entryID uint, destPath, onConflict string, userID uint) (*TrieNode, error) {
+    var restored *TrieNode
+    err := fs.DB.Transaction(func(tx *gorm.DB) error {
+        txfs := fs.withTx(tx)
+
+        var entry TrashEntry
+        if err := tx.Preload("TrieNode").Where("id = ? AND owner_id = ?", entryID, userID).First(&entry).Error; err != nil {
+            return errors.New("trash entry not found")
+        }
+
+        if destPath == "" {
+            destPath = entry.OriginalPath
+        }
+        dstParts := fs.SplitPath(destPath)
+        if dstParts == nil || len(dstParts) == 0 {
+            return errors.New("invalid restore path")
+        }
+        destPath = joinPath(dstParts)
+
+        if existing, err := txfs.Search(destPath, userID); err == nil {
+            switch onConflict {
+            case "rename":
+                destPath = txfs.freePath(destPath, userID)
+                dstParts = fs.SplitPath(destPath)
+            case "replace":
+                if _, err := txfs.Trash(existing.Path, true, userID); err != nil {
+                    return err
+                }
+            default:
+                return ErrRestoreConflict
+            }
+        }
+
+        parent, err := txfs.Insert(joinPath(dstParts[:len(dstParts)-1]), false, userID)
+        if err != nil {
+            return err
+        }
+        if parent.NodeType != "directory" {
+            return errors.New("restore parent is not a directory")
+        }
+
+        node := entry.TrieNode
+        if err := rebaseSubtree(tx, userID, node.Path, destPath, false); err != nil {
+            return err
+        }
+
+        node.Name = dstParts[len(dstParts)-1]
+        node.Path = destPath
+        node.ParentID = &parent.ID
+        node.Trashed = false
+        if err := tx.Save(&node).Error; err != nil {
+            return err
+        }
+        if node.NodeType == "file" {
+            tx.Model(&FileNode{}).Where("trie_node_id = ?", node.ID).Update("original_name", node.Name)
+        }
+
+        restored = &node
+        return tx.Delete(&entry).Error
+    })
+
+    return restored, err
+}
+
+// PurgeTrashEntry - Permanently deletes a trashed subtree, releasing its blocks and quota
+func (fs *FileSystem) PurgeTrashEntry(entry *TrashEntry) (int, error) {
+    var orphans []string
+    filesRemoved := 0
+
+    err := fs.DB.Transaction(func(tx *gorm.DB) error {
+        // The entry references the subtree root, so it goes first
+        if err := tx.Delete(entry).Error; err != nil {
+            return err
+        }
+
+        var node TrieNode
+        if err := tx.First(&node, entry.TrieNodeID).Error; err != nil {
+            return nil
+        }
+        var err error
+        orphans, filesRemoved, err = fs.withTx(tx).removeSubtree(&node, entry.OwnerID)
+        return err
+    })
+    if err != nil {
+        return 0, err
+    }
+
+    fs.reclaimBlobs(orphans)
+    return filesRemoved, nil
+}
+
+// rebaseSubtree rewrites descendant paths from oldPrefix to newPrefix
+func rebaseSubtree(tx *gorm.DB, userID uint, oldPrefix, newPrefix string, trashed bool) error {
+    return tx.Model(&TrieNode{}).
+        Where("owner_id = ?", userID).Where(belowPath(oldPrefix)).
+        Updates(map[string]interface{}{
+            "path":    rebasePath(oldPrefix, newPrefix),
+            "trashed": trashed,
+        }).Error
+}
+
+// freePath appends " (n)" before the extension until the path is unused
+func (fs *FileSystem) freePath(filePath string, userID uint) string {
+    dir, name := filePath[:strings.LastIndex(filePath, "/")+1], filePath[strings.LastIndex(filePath, "/")+1:]
+    base, ext := name, ""
+    if i := strings.LastIndex(name, "."); i > 0 {
+        base, ext = name[:i], name[i:]
+    }
+
+    for n := 1; ; n++ {
+        candidate := fmt.Sprintf("%s%s (%d)%s", dir, base, n, ext)
+        if _, err := fs.Search(candidate, userID); err != nil {
+            return candidate
+        }
+    }
+}
+
+// Trash handlers
+func (app *App) ListTrash(w http.ResponseWriter, r *http.Request) {
+    userID := app.getUserID(r)
+
+    var entries []TrashEntry
+    app.DB.Where("owner_id = ?", userID).Order("trashed_at desc").Find(&entries)
+
+    for i := range entries {
+        entries[i].PurgeAt = entries[i].TrashedAt.Add(app.TrashRetention)
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(entries)
+}
+
+func (app *App) RestoreTrash(w http.ResponseWriter, r *http.Request) {
+    userID := app.getUserID(r)
+    entryID, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+    var req struct {
+        DestPath   string `json:"dest_path,omitempty"`
+        OnConflict string `json:"on_conflict,omitempty"` // "fail", "rename" or "replace"
+    }
+    json.NewDecoder(r.Body).Decode(&req)
+
+    fs := NewFileSystem(app.DB, app.Blobs, app.Keys, userID)
+    node, err := fs.RestoreFromTrash(uint(entryID), req.DestPath, req.OnConflict, userID)
+    if err == ErrRestoreConflict {
+        http.Error(w, "Restore path is taken, retry with on_conflict=rename or replace", http.StatusConflict)
+        return
+    }
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(node)
+}
+
+// PurgeTrash permanently deletes one entry ({id}) or, without an id, empties the trash
+func (app *App) PurgeTrash(w http.ResponseWriter, r *http.Request) {
+    userID := app.getUserID(r)
+
+    query := app.DB.Where("owner_id = ?", userID)
+    if id, ok := mux.Vars(r)["id"]; ok {
+        query = query.Where("id = ?", id)
+    }
+
+    var entries []TrashEntry
+    query.Find(&entries)
+    if _, ok := mux.Vars(r)["id"]; ok && len(entries) == 0 {
+        http.Error(w, "Trash entry not found", http.StatusNotFound)
+        return
+    }
+
+    fs := NewFileSystem(app.DB, app.Blobs, app.Keys, userID)
+    filesRemoved := 0
+    for i := range entries {
+        n, err := fs.PurgeTrashEntry(&entries[i])
+        if err != nil {
+            http.Error(w, err.Error(), http.StatusInternalServerError)
+            return
+        }
+        filesRemoved += n
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "message":       "Trash emptied",
+        "files_removed": filesRemoved,
+    })
+}
+
+// StartTrashPurger permanently deletes entries older than the retention period, hourly
+func (app *App) StartTrashPurger() {
+    for {
+        app.purgeExpiredTrash()
+        time.Sleep(time.Hour)
+    }
+}
+
+func (app *App) purgeExpiredTrash() {
+    var expired []TrashEntry
+    app.DB.Where("trashed_at < ?", time.Now().Add(-app.TrashRetention)).Find(&expired)
+
+    for i := range expired {
+        fs := NewFileSystem(app.DB, app.Blobs, app.Keys, expired[i].OwnerID)
+        if _, err := fs.PurgeTrashEntry(&expired[i]); err != nil {
+            log.Printf("Failed to purge trash entry %d: %v", expired[i].ID, err)
+        }
+    }
+}
+
+// trashRetentionFromEnv reads TRASH_RETENTION_DAYS (30 by default)
+func trashRetentionFromEnv() time.Duration {
+    days, err := strconv.Atoi(os.Getenv("TRASH_RETENTION_DAYS"))
+    if err != nil || days < 0 {
+        return defaultTrashRetention
+    }
+    return time.Duration(days) * 24 * time.Hour
+}
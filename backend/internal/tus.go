@@ -0,0 +1,366 @@
+package internal
+
+import (
+    "encoding/base64"
+    "errors"
+    "fmt"
+    "io"
+    "net/http"
+    "os"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/gorilla/mux"
+    "gorm.io/gorm"
+    "gorm.io/gorm/clause"
+
+    "file-vault/pkg"
+)
+
+// Resumable uploads following the tus 1.0.0 protocol (core, creation, termination, expiration)
+const (
+    tusVersion     = "1.0.0"
+    tusExtensions  = "creation,termination,expiration"
+    tusUploadTTL   = 24 * time.Hour
+    tusContentType = "application/offset+octet-stream"
+)
+
+// Serializes PATCH requests against the same upload
+var tusLocks = make(map[string]*sync.Mutex)
+var tusLocksMutex sync.Mutex
+
+func lockUpload(id string) func() {
+    tusLocksMutex.Lock()
+    lock, exists := tusLocks[id]
+    if !exists {
+        lock = &sync.Mutex{}
+        tusLocks[id] = lock
+    }
+    tusLocksMutex.Unlock()
+
+    lock.Lock()
+    return lock.Unlock
+}
+
+func (app *App) partialPath(id string) string {
+    return filepath.Join(app.UploadDir, id)
+}
+
+// TusOptions advertises protocol support (no auth required)
+func (app *App) TusOptions(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Tus-Resumable", tusVersion)
+    w.Header().Set("Tus-Version", tusVersion)
+    w.Header().Set("Tus-Extension", tusExtensions)
+    w.WriteHeader(http.StatusNoContent)
+}
+
+// CreateUpload - tus creation: reserves an upload of Upload-Length bytes against the quota
+func (app *App) CreateUpload(w http.ResponseWriter, r *http.Request) {
+    if !checkTusVersion(w, r) {
+        return
+    }
+    userID := app.getUserID(r)
+
+    length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+    if err != nil || length < 0 {
+        http.Error(w, "Invalid Upload-Length", http.StatusBadRequest)
+        return
+    }
+
+    metadata := parseUploadMetadata(r.Header.Get("Upload-Metadata"))
+    filename := metadata["filename"]
+    if err := validateFileName(filename); err != nil {
+        http.Error(w, "Upload-Metadata must include a filename without path separators", http.StatusBadRequest)
+        return
+    }
+    directory := metadata["directory"]
+    if directory == "" {
+        directory = "/"
+    }
+
+    var fileMetadata Metadata
+    if value, ok := metadata["metadata"]; ok {
+        if fileMetadata, err = parseMetadata([]byte(value)); err != nil {
+            http.Error(w, err.Error(), http.StatusBadRequest)
+            return
+        }
+    }
+
+    app.purgeExpiredUploads()
+
+    session := &UploadSession{
+        ID:         utils.GenerateToken(),
+        OwnerID:    userID,
+        Filename:   filename,
+        MimeType:   metadata["filetype"],
+        Directory:  directory,
+        Versioning: metadata["versioning"] == "true",
+        Metadata:   fileMetadata,
+        Length:     length,
+        ExpiresAt:  time.Now().Add(tusUploadTTL),
+    }
+
+    if err := os.MkdirAll(app.UploadDir, 0o755); err != nil {
+        http.Error(w, "Failed to create upload", http.StatusInternalServerError)
+        return
+    }
+    f, err := os.Create(app.partialPath(session.ID))
+    if err != nil {
+        http.Error(w, "Failed to create upload", http.StatusInternalServerError)
+        return
+    }
+    f.Close()
+
+    if err := app.reserveUpload(session); err != nil {
+        os.Remove(app.partialPath(session.ID))
+        switch err {
+        case ErrQuotaExceeded:
+            http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+        case gorm.ErrRecordNotFound:
+            http.Error(w, "User not found", http.StatusNotFound)
+        default:
+            http.Error(w, "Failed to create upload", http.StatusInternalServerError)
+        }
+        return
+    }
+
+    // Zero-length uploads are complete as soon as they exist; there is nothing to retry
+    // with, so a failure discards the upload
+    if length == 0 {
+        fileNode, err := app.finishUpload(session)
+        if err != nil {
+            app.removeUpload(session)
+            http.Error(w, "Failed to store upload", http.StatusInternalServerError)
+            return
+        }
+        w.Header().Set("Upload-File-Id", strconv.FormatUint(uint64(fileNode.ID), 10))
+    }
+
+    w.Header().Set("Tus-Resumable", tusVersion)
+    w.Header().Set("Location", "/api/uploads/"+session.ID)
+    w.Header().Set("Upload-Expires", session.ExpiresAt.UTC().Format(http.TimeFormat))
+    w.WriteHeader(http.StatusCreated)
+}
+
+// reserveUpload records a new session, reserving its declared length against the owner's
+// quota. Live sessions are the reservations: finishing, terminating or expiring one
+// releases its bytes, so parallel sessions can't promise more than the quota left.
+func (app *App) reserveUpload(session *UploadSession) error {
+    return app.DB.Transaction(func(tx *gorm.DB) error {
+        // Locking the user serializes reservations against each other
+        var user User
+        if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&user, session.OwnerID).Error; err != nil {
+            return err
+        }
+
+        var reserved int64
+        err := tx.Model(&UploadSession{}).Where("owner_id = ? AND expires_at > ?", session.OwnerID, time.Now()).
+            Select("COALESCE(SUM(length), 0)").Scan(&reserved).Error
+        if err != nil {
+            return err
+        }
+        if user.QuotaUsed+reserved+session.Length > user.QuotaMax {
+            return ErrQuotaExceeded
+        }
+
+        return tx.Create(session).Error
+    })
+}
+
+// UploadStatus - tus HEAD: reports how many bytes the server has
+func (app *App) UploadStatus(w http.ResponseWriter, r *http.Request) {
+    if !checkTusVersion(w, r) {
+        return
+    }
+
+    session, ok := app.findUpload(w, r)
+    if !ok {
+        return
+    }
+
+    w.Header().Set("Tus-Resumable", tusVersion)
+    w.Header().Set("Cache-Control", "no-store")
+    w.Header().Set("Upload-Offset", strconv.FormatInt(session.Offset, 10))
+    w.Header().Set("Upload-Length", strconv.FormatInt(session.Length, 10))
+    w.Header().Set("Upload-Expires", session.ExpiresAt.UTC().Format(http.TimeFormat))
+    w.WriteHeader(http.StatusOK)
+}
+
+// PatchUpload - tus PATCH: appends bytes at Upload-Offset, assembling the file once complete
+func (app *App) PatchUpload(w http.ResponseWriter, r *http.Request) {
+    if !checkTusVersion(w, r) {
+        return
+    }
+    if r.Header.Get("Content-Type") != tusContentType {
+        http.Error(w, "Content-Type must be "+tusContentType, http.StatusUnsupportedMediaType)
+        return
+    }
+
+    unlock := lockUpload(mux.Vars(r)["id"])
+    defer unlock()
+
+    session, ok := app.findUpload(w, r)
+    if !ok {
+        return
+    }
+
+    offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+    if err != nil || offset < 0 {
+        http.Error(w, "Invalid Upload-Offset", http.StatusBadRequest)
+        return
+    }
+    if offset != session.Offset {
+        http.Error(w, "Upload-Offset does not match", http.StatusConflict)
+        return
+    }
+
+    f, err := os.OpenFile(app.partialPath(session.ID), os.O_WRONLY, 0o644)
+    if err != nil {
+        http.Error(w, "Upload data missing", http.StatusGone)
+        return
+    }
+    if _, err := f.Seek(session.Offset, io.SeekStart); err != nil {
+        f.Close()
+        http.Error(w, "Failed to resume upload", http.StatusInternalServerError)
+        return
+    }
+
+    // Keep whatever arrived even if the connection drops mid-request
+    written, copyErr := io.Copy(f, io.LimitReader(r.Body, session.Length-session.Offset))
+    f.Close()
+
+    session.Offset += written
+    app.DB.Model(session).Update("offset", session.Offset)
+
+    w.Header().Set("Tus-Resumable", tusVersion)
+    w.Header().Set("Upload-Offset", strconv.FormatInt(session.Offset, 10))
+    w.Header().Set("Upload-Expires", session.ExpiresAt.UTC().Format(http.TimeFormat))
+
+    if copyErr != nil {
+        http.Error(w, "Upload interrupted", http.StatusBadRequest)
+        return
+    }
+
+    if session.Offset == session.Length {
+        fileNode, err := app.finishUpload(session)
+        if err != nil {
+            status := http.StatusBadRequest
+            if errors.Is(err, ErrQuotaExceeded) {
+                status = http.StatusRequestEntityTooLarge
+            }
+            http.Error(w, err.Error(), status)
+            return
+        }
+        w.Header().Set("Upload-File-Id", strconv.FormatUint(uint64(fileNode.ID), 10))
+    }
+
+    w.WriteHeader(http.StatusNoContent)
+}
+
+// TerminateUpload - tus termination: discards an unfinished upload
+func (app *App) TerminateUpload(w http.ResponseWriter, r *http.Request) {
+    if !checkTusVersion(w, r) {
+        return
+    }
+
+    unlock := lockUpload(mux.Vars(r)["id"])
+    defer unlock()
+
+    session, ok := app.findUpload(w, r)
+    if !ok {
+        return
+    }
+
+    app.removeUpload(session)
+
+    w.Header().Set("Tus-Resumable", tusVersion)
+    w.WriteHeader(http.StatusNoContent)
+}
+
+// finishUpload feeds the assembled file through the normal dedup/trie path
+func (app *App) finishUpload(session *UploadSession) (*FileNode, error) {
+    f, err := os.Open(app.partialPath(session.ID))
+    if err != nil {
+        return nil, err
+    }
+    defer f.Close()
+
+    fs := NewFileSystem(app.DB, app.Blobs, app.Keys, session.OwnerID)
+    fileNode, err := fs.ProcessFileUpload(session.OwnerID, session.Filename, session.MimeType, f, session.Directory, UploadOptions{Versioning: session.Versioning, Metadata: session.Metadata})
+    if err != nil {
+        // Keep the bytes so the client can retry after freeing space or terminate
+        return nil, err
+    }
+
+    app.removeUpload(session)
+    return fileNode, nil
+}
+
+func (app *App) findUpload(w http.ResponseWriter, r *http.Request) (*UploadSession, bool) {
+    var session UploadSession
+    err := app.DB.Where("id = ? AND owner_id = ?", mux.Vars(r)["id"], app.getUserID(r)).First(&session).Error
+    if err != nil {
+        w.Header().Set("Tus-Resumable", tusVersion)
+        http.Error(w, "Upload not found", http.StatusNotFound)
+        return nil, false
+    }
+
+    if time.Now().After(session.ExpiresAt) {
+        app.removeUpload(&session)
+        w.Header().Set("Tus-Resumable", tusVersion)
+        http.Error(w, "Upload has expired", http.StatusGone)
+        return nil, false
+    }
+
+    return &session, true
+}
+
+func (app *App) removeUpload(session *UploadSession) {
+    os.Remove(app.partialPath(session.ID))
+    app.DB.Delete(session)
+
+    tusLocksMutex.Lock()
+    delete(tusLocks, session.ID)
+    tusLocksMutex.Unlock()
+}
+
+func (app *App) purgeExpiredUploads() {
+    var expired []UploadSession
+    app.DB.Where("expires_at < ?", time.Now()).Find(&expired)
+    for i := range expired {
+        app.removeUpload(&expired[i])
+    }
+}
+
+func checkTusVersion(w http.ResponseWriter, r *http.Request) bool {
+    if r.Header.Get("Tus-Resumable") != tusVersion {
+        w.Header().Set("Tus-Version", tusVersion)
+        http.Error(w, fmt.Sprintf("Tus-Resumable %s required", tusVersion), http.StatusPreconditionFailed)
+        return false
+    }
+    return true
+}
+
+// parseUploadMetadata decodes "key base64value,key2 base64value2"
+func parseUploadMetadata(header string) map[string]string {
+    metadata := make(map[string]string)
+    for _, pair := range strings.Split(header, ",") {
+        parts := strings.Fields(pair)
+        if len(parts) == 0 {
+            continue
+        }
+        value := ""
+        if len(parts) > 1 {
+            decoded, err := base64.StdEncoding.DecodeString(parts[1])
+            if err != nil {
+                continue
+            }
+            value = string(decoded)
+        }
+        metadata[parts[0]] = value
+    }
+    return metadata
+}
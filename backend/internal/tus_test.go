@@ -0,0 +1,56 @@
+package internal
+
+import (
+    "encoding/base64"
+    "net/http"
+    "net/http/httptest"
+    "reflect"
+    "testing"
+)
+
+func b64(s string) string {
+    return base64.StdEncoding.EncodeToString([]byte(s))
+}
+
+func TestParseUploadMetadata(t *testing.T) {
+    tests := []struct {
+        name   string
+        header string
+        want   map[string]string
+    }{
+        {"empty", "", map[string]string{}},
+        {"single", "filename " + b64("report.pdf"), map[string]string{"filename": "report.pdf"}},
+        {
+            "several with spaces",
+            "filename " + b64("a b.txt") + ", filetype " + b64("text/plain") + ",directory " + b64("/docs"),
+            map[string]string{"filename": "a b.txt", "filetype": "text/plain", "directory": "/docs"},
+        },
+        {"key without value", "versioning", map[string]string{"versioning": ""}},
+        {"invalid base64 is dropped", "filename !!!,filetype " + b64("text/plain"), map[string]string{"filetype": "text/plain"}},
+        {"utf-8 value", "filename " + b64("Über.txt"), map[string]string{"filename": "Über.txt"}},
+        {"blank pairs", " , ,filename " + b64("x"), map[string]string{"filename": "x"}},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            if got := parseUploadMetadata(tt.header); !reflect.DeepEqual(got, tt.want) {
+                t.Errorf("parseUploadMetadata(%q) = %v, want %v", tt.header, got, tt.want)
+            }
+        })
+    }
+}
+
+func TestCreateUploadRejectsUnsafeFilename(t *testing.T) {
+    app := &App{}
+    for _, name := range []string{"", ".", "..", "../secret", "a/b", `a\b`} {
+        req := httptest.NewRequest(http.MethodPost, "/api/uploads", nil)
+        req.Header.Set("Tus-Resumable", tusVersion)
+        req.Header.Set("Upload-Length", "10")
+        req.Header.Set("Upload-Metadata", "filename "+b64(name))
+        rec := httptest.NewRecorder()
+
+        app.CreateUpload(rec, req)
+        if rec.Code != http.StatusBadRequest {
+            t.Errorf("filename %q: status %d, want %d", name, rec.Code, http.StatusBadRequest)
+        }
+    }
+}
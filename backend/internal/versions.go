@@ -0,0 +1,299 @@
+package internal
+
+import (
+    "encoding/json"
+    "errors"
+    "net/http"
+    "strconv"
+    "time"
+
+    "github.com/gorilla/mux"
+    "gorm.io/gorm"
+)
+
+// File versioning: an opt-in re-upload archives the current content as a FileVersion
+// (which keeps its DataBlock referenced) and replaces it in place, so the FileNode id,
+// shares and links stay valid across versions.
+
+var ErrVersionNotFound = errors.New("version not found")
+
+// addVersion makes staged the current content of an existing file, archiving the old one
+func (fs *FileSystem) addVersion(trieNode *TrieNode, user *User, staged *stagedUpload, declaredMime string) (*FileNode, error) {
+    var fileNode FileNode
+    if err := fs.DB.Where("trie_node_id = ?", trieNode.ID).First(&fileNode).Error; err != nil {
+        return nil, err
+    }
+
+    // Re-uploading identical bytes is not a new version
+    if fileNode.Hash == staged.Hash {
+        return &fileNode, nil
+    }
+
+    block, isDeduped, err := fs.acquireBlock(staged, fileNode.OriginalName, declaredMime, user)
+    if err != nil {
+        return nil, err
+    }
+
+    err = fs.DB.Transaction(func(tx *gorm.DB) error {
+        if err := tx.Create(archivedVersion(&fileNode)).Error; err != nil {
+            return err
+        }
+        if err := tx.Save(user).Error; err != nil {
+            return err
+        }
+        return setFileContent(tx, &fileNode, FileVersion{
+            Hash:           staged.Hash,
+            Size:           staged.Size,
+            MimeType:       declaredMime,
+            ActualMimeType: staged.MimeType,
+            DataBlockID:    block.ID,
+            IsDeduped:      isDeduped,
+        })
+    })
+    if err != nil {
+        // The user row was rolled back, so there is no quota to return
+        orphans, _ := fs.releaseBlockRef(block.ID, staged.Size, true, user.ID)
+        fs.reclaimBlobs(orphans)
+        return nil, err
+    }
+
+    return &fileNode, nil
+}
+
+// RestoreVersion - Makes a retained version current again; the replaced content is
+// archived as a version too, so history only ever grows until pruned
+func (fs *FileSystem) RestoreVersion(fileNode *FileNode, version int, userID uint) (*FileNode, error) {
+    err := fs.DB.Transaction(func(tx *gorm.DB) error {
+        var target FileVersion
+        if err := tx.Where("file_node_id = ? AND version = ?", fileNode.ID, version).First(&target).Error; err != nil {
+            return ErrVersionNotFound
+        }
+
+        if err := tx.Create(archivedVersion(fileNode)).Error; err != nil {
+            return err
+        }
+
+        // The restored content shares the version's block, like a dedup hit
+        if err := tx.Model(&DataBlock{}).Where("id = ?", target.DataBlockID).
+            Update("ref_count", gorm.Expr("ref_count + 1")).Error; err != nil {
+            return err
+        }
+        if err := tx.Model(&User{}).Where("id = ?", userID).
+            Update("storage_saved", gorm.Expr("storage_saved + ?", target.Size)).Error; err != nil {
+            return err
+        }
+
+        target.IsDeduped = true
+        return setFileContent(tx, fileNode, target)
+    })
+
+    return fileNode, err
+}
+
+// PruneVersions - Drops retained versions beyond the newest keep (when keep >= 0) and
+// those uploaded before olderThan (when non-zero). Returns how many were removed.
+func (fs *FileSystem) PruneVersions(fileNode *FileNode, keep int, olderThan time.Time, userID uint) (int, error) {
+    var orphans []string
+    pruned := 0
+
+    err := fs.DB.Transaction(func(tx *gorm.DB) error {
+        var versions []FileVersion
+        if err := tx.Where("file_node_id = ?", fileNode.ID).Order("version desc").Find(&versions).Error; err != nil {
+            return err
+        }
+
+        txfs := fs.withTx(tx)
+        for i := range versions {
+            expired := !olderThan.IsZero() && versions[i].CreatedAt.Before(olderThan)
+            if (keep < 0 || i < keep) && !expired {
+                continue
+            }
+            released, err := txfs.releaseVersion(&versions[i], userID)
+            if err != nil {
+                return err
+            }
+            orphans = append(orphans, released...)
+            pruned++
+        }
+        return nil
+    })
+    if err != nil {
+        return 0, err
+    }
+
+    fs.reclaimBlobs(orphans)
+    return pruned, nil
+}
+
+// releaseVersion deletes a retained version and drops its data block reference
+func (fs *FileSystem) releaseVersion(version *FileVersion, userID uint) ([]string, error) {
+    if err := fs.DB.Delete(version).Error; err != nil {
+        return nil, err
+    }
+    return fs.releaseBlockRef(version.DataBlockID, version.Size, version.IsDeduped, userID)
+}
+
+// archivedVersion snapshots a file's current content as a FileVersion
+func archivedVersion(fileNode *FileNode) *FileVersion {
+    return &FileVersion{
+        FileNodeID:     fileNode.ID,
+        Version:        fileNode.Version,
+        Hash:           fileNode.Hash,
+        Size:           fileNode.Size,
+        MimeType:       fileNode.MimeType,
+        ActualMimeType: fileNode.ActualMimeType,
+        DataBlockID:    fileNode.DataBlockID,
+        IsDeduped:      fileNode.IsDeduped,
+        CreatedAt:      fileModTime(*fileNode),
+    }
+}
+
+// setFileContent replaces a file's content with content, bumping its version number
+func setFileContent(tx *gorm.DB, fileNode *FileNode, content FileVersion) error {
+    fileNode.Hash = content.Hash
+    fileNode.Size = content.Size
+    fileNode.MimeType = content.MimeType
+    fileNode.ActualMimeType = content.ActualMimeType
+    fileNode.DataBlockID = content.DataBlockID
+    fileNode.DataBlock = DataBlock{}
+    fileNode.IsDeduped = content.IsDeduped
+    fileNode.Version++
+    fileNode.ModifiedAt = time.Now()
+
+    // Updates with a map so zero values (is_deduped=false) are written
+    return tx.Model(&FileNode{}).Where("id = ?", fileNode.ID).Updates(map[string]interface{}{
+        "hash":             fileNode.Hash,
+        "size":             fileNode.Size,
+        "mime_type":        fileNode.MimeType,
+        "actual_mime_type": fileNode.ActualMimeType,
+        "data_block_id":    fileNode.DataBlockID,
+        "is_deduped":       fileNode.IsDeduped,
+        "version":          fileNode.Version,
+        "modified_at":      fileNode.ModifiedAt,
+    }).Error
+}
+
+// Version handlers
+func (app *App) ListFileVersions(w http.ResponseWriter, r *http.Request) {
+    fileNode, ok := app.ownedFile(w, r)
+    if !ok {
+        return
+    }
+
+    var versions []FileVersion
+    app.DB.Where("file_node_id = ?", fileNode.ID).Order("version desc").Find(&versions)
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "file_id":         fileNode.ID,
+        "current_version": fileNode.Version,
+        "modified_at":     fileModTime(*fileNode),
+        "versions":        versions,
+    })
+}
+
+func (app *App) DownloadFileVersion(w http.ResponseWriter, r *http.Request) {
+    fileNode, ok := app.ownedFile(w, r)
+    if !ok {
+        return
+    }
+    versionNum, _ := strconv.Atoi(mux.Vars(r)["version"])
+
+    var version FileVersion
+    if err := app.DB.Preload("DataBlock").Where("file_node_id = ? AND version = ?", fileNode.ID, versionNum).First(&version).Error; err != nil {
+        http.Error(w, "Version not found", http.StatusNotFound)
+        return
+    }
+
+    // Serve the version under the file's name; downloads of old versions aren't counted
+    view := *fileNode
+    view.Hash = version.Hash
+    view.Size = version.Size
+    view.ActualMimeType = version.ActualMimeType
+    view.DataBlock = version.DataBlock
+    view.ModifiedAt = version.CreatedAt
+    app.serveFile(w, r, view)
+}
+
+func (app *App) RestoreFileVersion(w http.ResponseWriter, r *http.Request) {
+    fileNode, ok := app.ownedFile(w, r)
+    if !ok {
+        return
+    }
+    versionNum, _ := strconv.Atoi(mux.Vars(r)["version"])
+
+    fs := NewFileSystem(app.DB, app.Blobs, app.Keys, fileNode.TrieNode.OwnerID)
+    restored, err := fs.RestoreVersion(fileNode, versionNum, fileNode.TrieNode.OwnerID)
+    if err == ErrVersionNotFound {
+        http.Error(w, "Version not found", http.StatusNotFound)
+        return
+    }
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(restored)
+}
+
+// PruneFileVersions deletes retained versions: ?keep=N keeps the newest N,
+// ?older_than_days=D drops versions uploaded more than D days ago
+func (app *App) PruneFileVersions(w http.ResponseWriter, r *http.Request) {
+    fileNode, ok := app.ownedFile(w, r)
+    if !ok {
+        return
+    }
+
+    keep := -1
+    var olderThan time.Time
+    if value := r.URL.Query().Get("keep"); value != "" {
+        n, err := strconv.Atoi(value)
+        if err != nil || n < 0 {
+            http.Error(w, "Invalid keep", http.StatusBadRequest)
+            return
+        }
+        keep = n
+    }
+    if value := r.URL.Query().Get("older_than_days"); value != "" {
+        days, err := strconv.Atoi(value)
+        if err != nil || days < 0 {
+            http.Error(w, "Invalid older_than_days", http.StatusBadRequest)
+            return
+        }
+        olderThan = time.Now().Add(-time.Duration(days) * 24 * time.Hour)
+    }
+    if keep < 0 && olderThan.IsZero() {
+        http.Error(w, "Specify keep or older_than_days", http.StatusBadRequest)
+        return
+    }
+
+    fs := NewFileSystem(app.DB, app.Blobs, app.Keys, fileNode.TrieNode.OwnerID)
+    pruned, err := fs.PruneVersions(fileNode, keep, olderThan, fileNode.TrieNode.OwnerID)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "message":         "Versions pruned",
+        "versions_pruned": pruned,
+    })
+}
+
+// ownedFile loads the {id} file for its owner; version history is never public
+func (app *App) ownedFile(w http.ResponseWriter, r *http.Request) (*FileNode, bool) {
+    fileID, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+    var fileNode FileNode
+    if err := app.DB.Preload("TrieNode").First(&fileNode, fileID).Error; err != nil || fileNode.TrieNode.Trashed {
+        http.Error(w, "File not found", http.StatusNotFound)
+        return nil, false
+    }
+    if fileNode.TrieNode.OwnerID != app.getUserID(r) {
+        http.Error(w, "Access denied", http.StatusForbidden)
+        return nil, false
+    }
+    return &fileNode, true
+}
@@ -8,19 +8,48 @@ CREATE TABLE users (
     quota_used BIGINT DEFAULT 0,
     quota_max BIGINT DEFAULT 10485760,
     storage_saved BIGINT DEFAULT 0,
+    totp_enabled BOOLEAN DEFAULT FALSE,
+    totp_secret VARCHAR(64),
+    totp_last_step BIGINT DEFAULT 0,
+    totp_failures INTEGER DEFAULT 0,
+    totp_locked_until TIMESTAMP,
+    email_verified BOOLEAN DEFAULT FALSE,
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
 );
 
--- Data blocks for deduplication
+-- Data blocks for deduplication (contents live in the blob store, keyed by hash)
 CREATE TABLE data_blocks (
     id SERIAL PRIMARY KEY,
     hash VARCHAR(64) UNIQUE NOT NULL,
-    data BYTEA,
     size BIGINT NOT NULL,
     ref_count INTEGER DEFAULT 1,
+    chunked BOOLEAN DEFAULT FALSE,
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
 );
 
+-- Content-defined chunks shared across data blocks
+CREATE TABLE chunks (
+    id SERIAL PRIMARY KEY,
+    hash VARCHAR(64) UNIQUE NOT NULL,
+    size BIGINT NOT NULL,
+    ref_count INTEGER DEFAULT 1,
+    codec VARCHAR(10) DEFAULT 'none', -- 'none', 'gzip', 'zstd'
+    stored_size BIGINT NOT NULL DEFAULT 0,
+    wrapped_key BYTEA, -- data key sealed by the master key (NULL = plaintext)
+    key_id VARCHAR(16), -- fingerprint of the wrapping master key
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Ordered chunk manifest of each chunked data block
+CREATE TABLE block_chunks (
+    id SERIAL PRIMARY KEY,
+    data_block_id INTEGER REFERENCES data_blocks(id) NOT NULL,
+    seq INTEGER NOT NULL,
+    chunk_id INTEGER REFERENCES chunks(id) NOT NULL,
+    "offset" BIGINT NOT NULL,
+    size BIGINT NOT NULL
+);
+
 -- Trie nodes (your C++ TrieNode hierarchy)
 CREATE TABLE trie_nodes (
     id SERIAL PRIMARY KEY,
@@ -30,6 +59,7 @@ CREATE TABLE trie_nodes (
     owner_id INTEGER REFERENCES users(id) NOT NULL,
     node_type VARCHAR(20) NOT NULL, -- 'file', 'directory', 'symlink'
     is_public BOOLEAN DEFAULT FALSE,
+    trashed BOOLEAN DEFAULT FALSE,
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
 );
 
@@ -46,7 +76,50 @@ CREATE TABLE file_nodes (
     ref_count INTEGER DEFAULT 1,
     downloads INTEGER DEFAULT 0,
     tags TEXT,
+    metadata JSONB NOT NULL DEFAULT '{}',
     is_deduped BOOLEAN DEFAULT FALSE,
+    version INTEGER DEFAULT 1,
+    modified_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Tags, unique per owner, and their links to files and directories
+CREATE TABLE tags (
+    id SERIAL PRIMARY KEY,
+    owner_id INTEGER REFERENCES users(id) NOT NULL,
+    name VARCHAR(64) NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (owner_id, name)
+);
+
+CREATE TABLE node_tags (
+    trie_node_id INTEGER REFERENCES trie_nodes(id) NOT NULL,
+    tag_id INTEGER REFERENCES tags(id) NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (trie_node_id, tag_id)
+);
+
+-- Superseded file versions (opt-in versioning on re-upload)
+CREATE TABLE file_versions (
+    id SERIAL PRIMARY KEY,
+    file_node_id INTEGER REFERENCES file_nodes(id) NOT NULL,
+    version INTEGER NOT NULL,
+    hash VARCHAR(64) NOT NULL,
+    size BIGINT NOT NULL,
+    mime_type VARCHAR(255) NOT NULL,
+    actual_mime_type VARCHAR(255) NOT NULL,
+    data_block_id INTEGER REFERENCES data_blocks(id) NOT NULL,
+    is_deduped BOOLEAN DEFAULT FALSE,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (file_node_id, version)
+);
+
+-- Text extracted at upload for full-text search, one row per data block
+CREATE TABLE document_texts (
+    id SERIAL PRIMARY KEY,
+    data_block_id INTEGER UNIQUE REFERENCES data_blocks(id) NOT NULL,
+    content TEXT NOT NULL,
+    search_vector TSVECTOR,
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
 );
 
@@ -87,9 +160,143 @@ CREATE TABLE audit_logs (
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
 );
 
+-- Resumable (tus) uploads in progress
+CREATE TABLE upload_sessions (
+    id VARCHAR(64) PRIMARY KEY,
+    owner_id INTEGER REFERENCES users(id) NOT NULL,
+    filename VARCHAR(255) NOT NULL,
+    mime_type VARCHAR(255),
+    directory VARCHAR(1000) NOT NULL,
+    versioning BOOLEAN DEFAULT FALSE,
+    metadata JSONB,
+    length BIGINT NOT NULL,
+    "offset" BIGINT DEFAULT 0,
+    expires_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Trash: deleted subtrees kept until purge
+CREATE TABLE trash_entries (
+    id SERIAL PRIMARY KEY,
+    owner_id INTEGER REFERENCES users(id) NOT NULL,
+    trie_node_id INTEGER REFERENCES trie_nodes(id) NOT NULL,
+    original_path VARCHAR(1000) NOT NULL,
+    node_type VARCHAR(20) NOT NULL,
+    size BIGINT DEFAULT 0,
+    trashed_at TIMESTAMP NOT NULL
+);
+
+-- Point-in-time directory snapshots
+CREATE TABLE snapshots (
+    id SERIAL PRIMARY KEY,
+    owner_id INTEGER REFERENCES users(id) NOT NULL,
+    name VARCHAR(255),
+    root_path VARCHAR(1000) NOT NULL,
+    file_count INTEGER DEFAULT 0,
+    total_size BIGINT DEFAULT 0,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE snapshot_entries (
+    id SERIAL PRIMARY KEY,
+    snapshot_id INTEGER REFERENCES snapshots(id) NOT NULL,
+    path VARCHAR(1000) NOT NULL,
+    parent_path VARCHAR(1000) NOT NULL,
+    name VARCHAR(255) NOT NULL,
+    node_type VARCHAR(20) NOT NULL,
+    is_public BOOLEAN DEFAULT FALSE,
+    target_path VARCHAR(1000),
+    hash VARCHAR(64),
+    size BIGINT DEFAULT 0,
+    mime_type VARCHAR(255),
+    actual_mime_type VARCHAR(255),
+    data_block_id INTEGER REFERENCES data_blocks(id),
+    tags TEXT,
+    metadata JSONB,
+    modified_at TIMESTAMP
+);
+
+-- Rotating refresh tokens (hashed) and denylisted access token ids
+CREATE TABLE refresh_tokens (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER REFERENCES users(id) NOT NULL,
+    family_id VARCHAR(64) NOT NULL,
+    token_hash VARCHAR(64) UNIQUE NOT NULL,
+    access_jti VARCHAR(64) NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    revoked_at TIMESTAMP,
+    user_agent TEXT,
+    ip_address VARCHAR(64),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE revoked_tokens (
+    jti VARCHAR(64) PRIMARY KEY,
+    user_id INTEGER REFERENCES users(id) NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Scoped API keys (hashed)
+CREATE TABLE api_keys (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER REFERENCES users(id) NOT NULL,
+    name VARCHAR(255) NOT NULL,
+    prefix VARCHAR(16) NOT NULL,
+    key_hash VARCHAR(64) UNIQUE NOT NULL,
+    scopes TEXT NOT NULL,
+    last_used_at TIMESTAMP,
+    expires_at TIMESTAMP,
+    revoked_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Two-factor recovery codes (hashed) and runtime settings
+CREATE TABLE recovery_codes (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER REFERENCES users(id) NOT NULL,
+    code_hash VARCHAR(64) NOT NULL,
+    used_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE settings (
+    key VARCHAR(64) PRIMARY KEY,
+    value TEXT NOT NULL,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Single-use password reset and email verification links
+CREATE TABLE account_tokens (
+    jti VARCHAR(64) PRIMARY KEY,
+    user_id INTEGER REFERENCES users(id) NOT NULL,
+    purpose VARCHAR(32) NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    used_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
 -- Indexes for performance
 CREATE INDEX idx_trie_nodes_path ON trie_nodes(path);
 CREATE INDEX idx_trie_nodes_parent ON trie_nodes(parent_id);
 CREATE INDEX idx_file_nodes_hash ON file_nodes(hash);
 CREATE INDEX idx_data_blocks_hash ON data_blocks(hash);
+CREATE INDEX idx_chunks_hash ON chunks(hash);
+CREATE INDEX idx_chunks_key_id ON chunks(key_id);
+CREATE INDEX idx_block_chunks_block ON block_chunks(data_block_id, seq);
 CREATE INDEX idx_shares_token ON shares(token);
+CREATE INDEX idx_upload_sessions_owner ON upload_sessions(owner_id);
+CREATE INDEX idx_trash_entries_owner ON trash_entries(owner_id);
+CREATE INDEX idx_trash_entries_trashed_at ON trash_entries(trashed_at);
+CREATE INDEX idx_snapshots_owner ON snapshots(owner_id);
+CREATE INDEX idx_snapshot_entry_parent ON snapshot_entries(snapshot_id, parent_path);
+CREATE INDEX idx_node_tags_tag ON node_tags(tag_id);
+CREATE INDEX idx_refresh_tokens_user ON refresh_tokens(user_id);
+CREATE INDEX idx_refresh_tokens_family ON refresh_tokens(family_id);
+CREATE INDEX idx_refresh_tokens_expires ON refresh_tokens(expires_at);
+CREATE INDEX idx_revoked_tokens_expires ON revoked_tokens(expires_at);
+CREATE INDEX idx_api_keys_user ON api_keys(user_id);
+CREATE INDEX idx_recovery_codes_user ON recovery_codes(user_id);
+CREATE INDEX idx_account_tokens_user ON account_tokens(user_id);
+CREATE INDEX idx_account_tokens_expires ON account_tokens(expires_at);
+CREATE INDEX idx_document_texts_search ON document_texts USING GIN (search_vector);
@@ -46,6 +46,7 @@ function App() {
     try {
       const response = await authAPI.login(loginForm.email, loginForm.password);
       localStorage.setItem('token', response.token);
+      localStorage.setItem('refresh_token', response.refresh_token);
       localStorage.setItem('user', JSON.stringify(response.user));
       setUser(response.user);
       toast.success('Welcome back!');
@@ -62,6 +63,7 @@ function App() {
     try {
       const response = await authAPI.register(registerForm.username, registerForm.email, registerForm.password);
       localStorage.setItem('token', response.token);
+      localStorage.setItem('refresh_token', response.refresh_token);
       localStorage.setItem('user', JSON.stringify(response.user));
       setUser(response.user);
       toast.success('Account created successfully!');
@@ -117,7 +119,9 @@ function App() {
   };
 
   const handleLogout = () => {
+    authAPI.logout().catch(() => {});
     localStorage.removeItem('token');
+    localStorage.removeItem('refresh_token');
     localStorage.removeItem('user');
     setUser(null);
     setFiles([]);
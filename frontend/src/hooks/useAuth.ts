@@ -17,6 +17,7 @@ export const useAuth = () => {
       setLoading(true);
       const response = await authAPI.login(email, password);
       localStorage.setItem('token', response.token);
+      localStorage.setItem('refresh_token', response.refresh_token);
       setUser(response.user);
       return true;
     } catch (error) {
@@ -32,6 +33,7 @@ export const useAuth = () => {
       setLoading(true);
       const response = await authAPI.register(username, email, password);
       localStorage.setItem('token', response.token);
+      localStorage.setItem('refresh_token', response.refresh_token);
       setUser(response.user);
       return true;
     } catch (error) {
@@ -43,7 +45,9 @@ export const useAuth = () => {
   };
 
   const logout = () => {
+    authAPI.logout().catch(() => {});
     localStorage.removeItem('token');
+    localStorage.removeItem('refresh_token');
     setUser(null);
   };
 
@@ -16,17 +16,70 @@ api.interceptors.request.use((config) => {
   return config;
 });
 
+// Access tokens are short-lived: on a 401, rotate the refresh token once and retry.
+// Concurrent failures share one refresh, since each refresh token is single-use.
+let refreshing: Promise<string | null> | null = null;
+
+const refreshSession = async (): Promise<string | null> => {
+  const refreshToken = localStorage.getItem('refresh_token');
+  if (!refreshToken) return null;
+  try {
+    const response = await axios.post(`${API_BASE_URL}/auth/refresh`, { refresh_token: refreshToken });
+    localStorage.setItem('token', response.data.token);
+    localStorage.setItem('refresh_token', response.data.refresh_token);
+    return response.data.token;
+  } catch {
+    localStorage.removeItem('token');
+    localStorage.removeItem('refresh_token');
+    return null;
+  }
+};
+
+api.interceptors.response.use(undefined, async (error) => {
+  const original = error.config;
+  if (error.response?.status !== 401 || !original || original._retried || original.url?.startsWith('/auth/')) {
+    return Promise.reject(error);
+  }
+  original._retried = true;
+
+  refreshing = refreshing || refreshSession().finally(() => { refreshing = null; });
+  const token = await refreshing;
+  if (!token) return Promise.reject(error);
+
+  original.headers.Authorization = `Bearer ${token}`;
+  return api(original);
+});
+
 // Auth API
 export const authAPI = {
   login: async (email: string, password: string) => {
     const response = await api.post('/auth/login', { email, password });
-    return response.data;
+    if (!response.data.two_factor_required) return response.data;
+
+    // Two-step login: the password earned a challenge, a TOTP or recovery code finishes it
+    const code = window.prompt('Enter the code from your authenticator app (or a recovery code)') || '';
+    const isRecovery = code.includes('-');
+    const session = await api.post('/auth/2fa', {
+      challenge_token: response.data.challenge_token,
+      code: isRecovery ? undefined : code,
+      recovery_code: isRecovery ? code : undefined,
+    });
+    return session.data;
   },
 
   register: async (username: string, email: string, password: string) => {
     const response = await api.post('/auth/register', { username, email, password });
     return response.data;
   },
+
+  logout: async () => {
+    const refreshToken = localStorage.getItem('refresh_token');
+    await api.post('/auth/logout', { refresh_token: refreshToken });
+  },
+
+  logoutAll: async () => {
+    await api.post('/auth/logout-all');
+  },
 };
 
 // User API
@@ -41,8 +94,9 @@ export const userAPI = {
 export const filesAPI = {
   uploadFiles: async (files: File[], directory?: string) => {
     const formData = new FormData();
-    files.forEach(file => formData.append('files', file));
+    // The backend streams parts in order, so the directory must come before the files
     if (directory) formData.append('directory', directory);
+    files.forEach(file => formData.append('files', file));
     
     const response = await api.post('/files', formData, {
       headers: { 'Content-Type': 'multipart/form-data' },
@@ -6,6 +6,7 @@ export interface User {
   quota_used: number;
   quota_max: number;
   storage_saved: number;
+  email_verified: boolean;
   created_at: string;
 }
 
@@ -18,7 +19,10 @@ export interface FileNode {
   actual_mime_type: string;
   downloads: number;
   tags: string;
+  metadata: Record<string, unknown>;
   is_deduped: boolean;
+  version: number;
+  modified_at: string;
   created_at: string;
   trie_node: {
     id: number;
@@ -42,6 +46,12 @@ export interface Directory {
   created_at: string;
 }
 
+export interface Tag {
+  id: number;
+  name: string;
+  count: number;
+}
+
 export interface Share {
   id: number;
   token: string;
@@ -58,6 +68,13 @@ export interface StorageStats {
   space_saved: number;
   deduplication_ratio: number;
   efficiency: string;
+  unique_chunks: number;
+  chunk_referenced_size: number;
+  chunk_space_saved: number;
+  chunk_dedup_ratio: number;
+  compressed_chunks: number;
+  compression_saved: number;
+  compression_ratio: number;
 }
 
 export interface SearchFilters {